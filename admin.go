@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// serveAdmin serves the admin HTTP endpoints on ADMIN_ADDR, or 127.0.0.1:8080 if it is not set.
+// Requests must send ADMIN_TOKEN as a bearer token; without a token the endpoints are not served.
+//
+//	GET /explain?cell=C5 returns the provenance of a generated cell.
+func serveAdmin() {
+	if os.Getenv("ADMIN_TOKEN") == "" {
+		log.Printf("ADMIN_TOKEN is not set, admin endpoint disabled\n")
+		return
+	}
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8080"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/explain", adminHandler(func(w http.ResponseWriter, r *http.Request) {
+		cell := r.URL.Query().Get("cell")
+		if cell == "" {
+			http.Error(w, "missing cell parameter", http.StatusBadRequest)
+			return
+		}
+		provenance, err := explainCell(cell)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, provenance)
+	}))
+
+	log.Printf("Admin endpoint listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving admin endpoint: %v", err)
+	}
+}
+
+// adminHandler wraps a handler with the ADMIN_TOKEN check.
+func adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeJSON writes a value as an indented JSON response.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
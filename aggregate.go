@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// chunkModeAggregate is the VARx_MODE of chunks that write one summary per group of rows to a separate tab.
+const chunkModeAggregate = "AGGREGATE"
+
+// aggregateRetryDelay is how long a group whose run failed waits before it is retried. It doubles with every
+// further failure of the same group contents, up to aggregateMaxRetryDelay.
+const aggregateRetryDelay = time.Minute
+const aggregateMaxRetryDelay = time.Hour
+
+// aggregateGroupsRunning holds the Redis keys of the groups whose run is in flight,
+// so a group that takes longer than a poll is not dispatched again.
+var aggregateGroupsRunning sync.Map
+
+// aggregateFailure records the failed runs of a group for the group contents they were tried with.
+type aggregateFailure struct {
+	Hash     string
+	Attempts int
+	RetryAt  time.Time
+}
+
+// aggregateFailures maps the Redis key of a group to its failed runs.
+var aggregateFailures = make(map[string]aggregateFailure)
+var aggregateFailuresMutex = &sync.Mutex{}
+
+// aggregateBackingOff reports whether a group failed with the same contents and its retry delay has not passed.
+func aggregateBackingOff(redisKey string, hash string, now time.Time) bool {
+	aggregateFailuresMutex.Lock()
+	defer aggregateFailuresMutex.Unlock()
+	failure, ok := aggregateFailures[redisKey]
+	return ok && failure.Hash == hash && now.Before(failure.RetryAt)
+}
+
+// recordAggregateResult clears a group's failures after a successful run, or counts a failed one
+// and schedules its retry.
+func recordAggregateResult(redisKey string, hash string, err error) {
+	aggregateFailuresMutex.Lock()
+	defer aggregateFailuresMutex.Unlock()
+	if err == nil {
+		delete(aggregateFailures, redisKey)
+		return
+	}
+	failure := aggregateFailures[redisKey]
+	if failure.Hash != hash {
+		failure = aggregateFailure{Hash: hash}
+	}
+	failure.Attempts++
+	delay := aggregateRetryDelay << (failure.Attempts - 1)
+	if failure.Attempts > 6 || delay > aggregateMaxRetryDelay {
+		delay = aggregateMaxRetryDelay
+	}
+	failure.RetryAt = time.Now().Add(delay)
+	aggregateFailures[redisKey] = failure
+}
+
+// aggregateColumns returns the header of an aggregate chunk's output tab:
+// the GROUP_BY column, the destination columns, the number of member rows and the time of the last update.
+func (c ChunkSettings) aggregateColumns() []interface{} {
+	header := []interface{}{c.GroupBy}
+	for _, columnName := range c.destinationColumns() {
+		if columnName == "" {
+			columnName = "Result"
+		}
+		header = append(header, columnName)
+	}
+	return append(header, "Rows", "Updated")
+}
+
+// runAggregateChunks groups the rows of the watched sheet for every aggregate chunk and runs the chunk
+// for each group whose member rows changed since the group was last summarized.
+// Groups whose run is still in flight are skipped, and groups whose run failed wait for their retry delay.
+func runAggregateChunks(currentRows [][]interface{}) {
+	for _, gptSettings := range gptSettingsByName {
+		if gptSettings.Mode != chunkModeAggregate {
+			continue
+		}
+		// Group hashes are left unchanged so inactive groups run once the chunk is active
+		if !gptSettings.isActive(time.Now()) {
+			continue
+		}
+		if !gptSettings.hasPrompts() {
+			continue
+		}
+		if gptSettings.Temperature == 0 || gptSettings.MaxTokens == 0 {
+			continue
+		}
+		if gptSettings.GroupBy == "" || gptSettings.OutputTab == "" {
+			continue
+		}
+		groupColumn, ok := columnIndexByName[gptSettings.GroupBy]
+		if !ok {
+			log.Printf("Error: GROUP_BY column '%s' of '%s' does not exist", gptSettings.GroupBy, gptSettings.Name)
+			continue
+		}
+
+		var groupKeys []string
+		members := make(map[string][]int)
+		for rowIndex := 1; rowIndex < len(currentRows); rowIndex++ {
+			if groupColumn >= len(currentRows[rowIndex]) {
+				continue
+			}
+			key := strings.TrimSpace(fmt.Sprint(currentRows[rowIndex][groupColumn]))
+			if key == "" {
+				continue
+			}
+			if _, ok := members[key]; !ok {
+				groupKeys = append(groupKeys, key)
+			}
+			members[key] = append(members[key], rowIndex)
+		}
+
+		for _, key := range groupKeys {
+			hash := groupHash(currentRows, members[key], gptSettings)
+			redisKey := aggregateRedisKey(gptSettings.Name, key)
+			prevHash, err := redisClient.Get(redisKey).Result()
+			if err != nil && err != redis.Nil {
+				log.Printf("Error getting value from Redis: %v", err)
+				continue
+			}
+			if prevHash == hash || aggregateBackingOff(redisKey, hash, time.Now()) {
+				continue
+			}
+			if _, running := aggregateGroupsRunning.LoadOrStore(redisKey, true); running {
+				continue
+			}
+
+			log.Printf("Group '%s' change triggered gptSettings '%s'\n", key, gptSettings.Name)
+			runAggregateGroupWithSemaphore(gptSettings, key, members[key], currentRows, redisKey, hash)
+		}
+	}
+}
+
+// aggregateRedisKey returns the Redis key of a group's hash. The group value is hashed so values containing
+// the separator cannot make two groups share a key.
+func aggregateRedisKey(chunkName, groupKey string) string {
+	return fmt.Sprintf("aggregate:%s:%x", chunkName, sha256.Sum256([]byte(groupKey)))
+}
+
+// groupHash hashes the trigger columns of a group's member rows, or every column if the chunk has no trigger columns.
+// With ON_PROMPT_CHANGE set to rerun-all the chunk's definition is hashed too, so every group is rerun when it changes.
+func groupHash(currentRows [][]interface{}, memberRows []int, gptSettings ChunkSettings) string {
+	h := sha256.New()
+	if gptSettings.OnPromptChange == promptChangeRerunAll {
+		fmt.Fprintf(h, "definition:%s\n", gptSettings.definitionHash())
+	}
+	for _, rowIndex := range memberRows {
+		row := currentRows[rowIndex]
+		if len(gptSettings.TriggerColumn) == 0 {
+			fmt.Fprintf(h, "%d:%v\n", rowIndex, row)
+			continue
+		}
+		for _, triggerColumn := range gptSettings.TriggerColumn {
+			if columnIndex, ok := columnIndexByName[triggerColumn]; ok && columnIndex < len(row) {
+				fmt.Fprintf(h, "%d:%s=%v\n", rowIndex, triggerColumn, row[columnIndex])
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// groupRow builds the row the templates of an aggregate chunk are rendered with.
+// Every column token is replaced with the values of its member rows, one per line, {GROUP} with the group key,
+// {ROW_COUNT} with the number of member rows and {ROWS} with every member row as "Column: value" pairs.
+func groupRow(key string, memberRows []int, currentRows [][]interface{}, groupBy string) map[string]interface{} {
+	row := map[string]interface{}{"RowIndex": memberRows[0]}
+	var rendered []string
+	for columnIndex, columnName := range columnNameByIndex {
+		var values []string
+		for _, rowIndex := range memberRows {
+			if columnIndex < len(currentRows[rowIndex]) {
+				if value := fmt.Sprint(currentRows[rowIndex][columnIndex]); value != "" {
+					values = append(values, value)
+				}
+			}
+		}
+		row[columnName] = strings.Join(values, "\n")
+	}
+	for _, rowIndex := range memberRows {
+		var pairs []string
+		for columnIndex, value := range currentRows[rowIndex] {
+			if value != "" {
+				pairs = append(pairs, fmt.Sprintf("%s: %v", columnNameByIndex[columnIndex], value))
+			}
+		}
+		rendered = append(rendered, strings.Join(pairs, "; "))
+	}
+	row[groupBy] = key
+	row["GROUP"] = key
+	row["ROW_COUNT"] = len(memberRows)
+	row["ROWS"] = strings.Join(rendered, "\n")
+	return row
+}
+
+// runAggregateGroupWithSemaphore runs an aggregate chunk for one group in a goroutine,
+// holding a token from the gptSemaphore like runGptSettingsOnRowWithSemaphore does.
+// The group must have been marked in flight in aggregateGroupsRunning; the mark is cleared when the run ends.
+func runAggregateGroupWithSemaphore(gptSettings ChunkSettings, key string, memberRows []int, currentRows [][]interface{}, redisKey string, hash string) {
+	row := groupRow(key, memberRows, currentRows, gptSettings.GroupBy)
+	gptSemaphore <- struct{}{}
+	wg.Add(1) // Increment WaitGroup counter
+	go func() {
+		defer wg.Done() // Decrement WaitGroup counter when goroutine finishes
+		defer func() { <-gptSemaphore }()
+		defer aggregateGroupsRunning.Delete(redisKey)
+		err := runAggregateGroup(gptSettings, key, row, len(memberRows))
+		recordAggregateResult(redisKey, hash, err)
+		if err != nil {
+			log.Printf("Error running aggregate group '%s' of '%s': %v", key, gptSettings.Name, err)
+			return
+		}
+		if err := redisClient.Set(redisKey, hash, 0).Err(); err != nil {
+			log.Printf("Error setting value in Redis: %v", err)
+		}
+	}()
+}
+
+// runAggregateGroup renders the chunk's prompts for a group, fetches the response and writes it to the group's row
+// in the chunk's OUTPUT_TAB, creating the tab and appending a row for new groups.
+// A response that fails validation is written as the fallback value or an error status,
+// so the group is not retried until one of its rows changes again.
+// It returns an error if an error occurred.
+func runAggregateGroup(gptSettings ChunkSettings, key string, row map[string]interface{}, memberCount int) error {
+	systemMessage := renderTemplate(gptSettings.SystemMessage, row)
+	userMessage := renderTemplate(gptSettings.UserMessage, row)
+	request := newChatRequest(gptSettings, row, systemMessage, userMessage)
+
+	var values []interface{}
+	result, err := requestCompletion(gptSettings, request, fmt.Sprintf("Group '%s'", key))
+	if invalid, ok := err.(*validationError); ok {
+		values = gptSettings.fallbackValues()
+		if values == nil {
+			values = make([]interface{}, len(gptSettings.destinationColumns()))
+			for i := range values {
+				values[i] = ""
+			}
+			values[gptSettings.guardedIndex()] = errorStatusPrefix + invalid.Err.Error()
+		}
+	} else if err != nil {
+		return err
+	} else {
+		values = result.Values
+	}
+
+	mode := gptSettings.Safety.sanitizeMode()
+	output := []interface{}{key}
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			if runes := []rune(s); len(runes) >= maxCellLength {
+				s = string(runes[:maxCellLength-1])
+			}
+			if mode == sanitizeEscape {
+				s, _ = escapeFormula(s)
+			}
+			value = s
+		}
+		output = append(output, value)
+	}
+	output = append(output, memberCount, time.Now().Format(time.RFC3339))
+
+	defer lockTab(gptSettings.OutputTab)()
+
+	if _, err := ensureSheet(gptSettings.OutputTab, gptSettings.aggregateColumns()); err != nil {
+		return err
+	}
+
+	resp, err := readFromSheetWithRateLimit(spreadsheetID, fmt.Sprintf("'%s'!A:A", gptSettings.OutputTab))
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", gptSettings.OutputTab, err)
+	}
+	targetRow := len(resp.Values) + 1
+	for i, existing := range resp.Values {
+		if i > 0 && len(existing) > 0 && fmt.Sprint(existing[0]) == key {
+			targetRow = i + 1
+			break
+		}
+	}
+
+	range_ := fmt.Sprintf("'%s'!A%d:%s%d", gptSettings.OutputTab, targetRow, getExcelColumnName(len(output)), targetRow)
+	_, err = batchWriteToSheetWithRateLimit(spreadsheetID, []*sheets.ValueRange{
+		{
+			Range:  range_,
+			Values: [][]interface{}{output},
+		},
+	}, gptSettings.Safety.valueInputOption())
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %v", range_, err)
+	}
+	log.Printf("Updated group '%s' in %s row #%d\n", key, gptSettings.OutputTab, targetRow)
+
+	return nil
+}
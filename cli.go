@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// cliUsage lists the subcommands the binary accepts instead of running the engine.
+const cliUsage = `usage:
+  crosstab                 run the engine
+  crosstab explain <cell>  print the provenance of a generated cell, e.g. crosstab explain C5
+  crosstab restore [COLUMN <name>] [ROW <number>] TO <time>
+                           roll cells back to their value at a time, e.g. crosstab restore COLUMN Summary TO 2026-10-01
+  crosstab eval [chunk...]  score chunks against their EXPECTED_COL and write the results to the eval tab
+  crosstab export-finetune <file> [chunk...]
+                           write approved and corrected samples as OpenAI chat fine-tuning JSONL`
+
+// runCLI runs a subcommand given on the command line.
+// It returns an error if the subcommand is unknown or fails.
+func runCLI(args []string) error {
+	switch args[0] {
+	case "explain":
+		if len(args) != 2 {
+			return fmt.Errorf("expected a cell\n%s", cliUsage)
+		}
+		provenance, err := explainCell(args[1])
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(provenance)
+	case "restore":
+		if err := readSettings(); err != nil {
+			return err
+		}
+		column, rowNumber, at, err := parseRestoreCommand(args[1:])
+		if err != nil {
+			return fmt.Errorf("%v\n%s", err, cliUsage)
+		}
+		restored, err := restoreHistory(column, rowNumber, at)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %d cell(s)\n", restored)
+		return nil
+	case "eval":
+		if err := readSettings(); err != nil {
+			return err
+		}
+		summaries, err := runEval(args[1:])
+		for _, summary := range summaries {
+			fmt.Println(summary)
+		}
+		return err
+	case "export-finetune":
+		if len(args) < 2 {
+			return fmt.Errorf("expected a file\n%s", cliUsage)
+		}
+		if err := readSettings(); err != nil {
+			return err
+		}
+		written, err := exportFineTune(args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d example(s) to %s\n", written, args[1])
+		return nil
+	case "help", "-h", "--help":
+		fmt.Println(cliUsage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], cliUsage)
+}
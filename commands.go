@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// pausedKey is the Redis key that keeps the PAUSE/RESUME state across restarts.
+const pausedKey = "engine:paused"
+
+// enginePaused is true while a PAUSE command is in effect. No chunk is dispatched while paused and trigger changes
+// are left uncached, so they are picked up once the engine resumes.
+var enginePaused bool
+
+// commandRow is the row number of the COMMAND setting in the Settings tab, or 0 if there is none.
+var commandRow int
+
+// pendingReruns maps a chunk name to the row ranges a RERUN command asked to regenerate on the next poll.
+var pendingReruns = make(map[string][]rerunRange)
+
+// rerunRange is an inclusive range of sheet row numbers, where 0 means unbounded.
+type rerunRange struct {
+	First int
+	Last  int
+}
+
+// contains reports whether a sheet row number is in the range.
+func (r rerunRange) contains(rowNumber int) bool {
+	return (r.First == 0 || rowNumber >= r.First) && (r.Last == 0 || rowNumber <= r.Last)
+}
+
+// loadEnginePaused restores the PAUSE/RESUME state saved in Redis.
+func loadEnginePaused() {
+	paused, err := redisClient.Get(pausedKey).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error getting value from Redis: %v", err)
+		}
+		return
+	}
+	enginePaused, _ = strconv.ParseBool(paused)
+}
+
+// setEnginePaused changes the PAUSE/RESUME state and saves it in Redis.
+func setEnginePaused(paused bool) {
+	enginePaused = paused
+	if err := redisClient.Set(pausedKey, strconv.FormatBool(paused), 0).Err(); err != nil {
+		log.Printf("Error setting value in Redis: %v", err)
+	}
+}
+
+// processCommand executes the COMMAND cell of the Settings tab, if any, and clears it so it only runs once.
+// Supported commands are "RERUN VAR3 ROWS 10-40", "RERUN VAR3 ROW 12", "RERUN ALL VAR2", "PAUSE", "RESUME"
+// and "RESTORE COLUMN Summary TO 2026-10-01 12:00", see parseRestoreCommand.
+// It returns an error if the command is invalid or the cell could not be cleared.
+func processCommand() error {
+	command, ok := allSettings["GLOBAL"]["COMMAND"].(string)
+	if !ok || strings.TrimSpace(command) == "" || commandRow == 0 {
+		return nil
+	}
+
+	log.Printf("Running command '%s'\n", command)
+	commandErr := runCommand(command)
+
+	vr := &sheets.ValueRange{
+		Values: [][]interface{}{{""}},
+	}
+	_, err := writeToSheetWithRateLimit(spreadsheetID, fmt.Sprintf("Settings!B%d", commandRow), vr)
+	if err != nil {
+		return fmt.Errorf("unable to clear command: %v", err)
+	}
+	delete(allSettings["GLOBAL"], "COMMAND")
+
+	return commandErr
+}
+
+// runCommand parses and executes a command.
+// It returns an error if the command is invalid.
+func runCommand(command string) error {
+	fields := strings.Fields(strings.ToUpper(command))
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "RESTORE":
+		// Column names are case sensitive, so parse the command as typed
+		column, rowNumber, at, err := parseRestoreCommand(strings.Fields(command)[1:])
+		if err != nil {
+			return fmt.Errorf("command %q: %v", command, err)
+		}
+		restored, err := restoreHistory(column, rowNumber, at)
+		if err != nil {
+			return fmt.Errorf("command %q: %v", command, err)
+		}
+		log.Printf("Restored %d cell(s)\n", restored)
+		return nil
+	case "PAUSE":
+		setEnginePaused(true)
+		log.Printf("Engine paused\n")
+		return nil
+	case "RESUME":
+		setEnginePaused(false)
+		log.Printf("Engine resumed\n")
+		return nil
+	case "RERUN":
+		fields = fields[1:]
+		if len(fields) > 0 && fields[0] == "ALL" {
+			fields = fields[1:]
+			if len(fields) != 1 {
+				return fmt.Errorf("command %q: expected RERUN ALL <chunk>", command)
+			}
+			return queueRerun(fields[0], rerunRange{})
+		}
+		if len(fields) != 3 || (fields[1] != "ROWS" && fields[1] != "ROW") {
+			return fmt.Errorf("command %q: expected RERUN <chunk> ROWS <first>-<last>", command)
+		}
+		first, last, err := parseRowRange(fields[2])
+		if err != nil {
+			return fmt.Errorf("command %q: %v", command, err)
+		}
+		return queueRerun(fields[0], rerunRange{First: first, Last: last})
+	}
+
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// queueRerun asks for a chunk to be regenerated for a range of rows on the next poll.
+// It returns an error if there is no chunk with that name.
+func queueRerun(chunkName string, rows rerunRange) error {
+	if _, ok := gptSettingsByName[chunkName]; !ok {
+		return fmt.Errorf("unknown chunk %q", chunkName)
+	}
+	pendingReruns[chunkName] = append(pendingReruns[chunkName], rows)
+	log.Printf("Queued rerun of '%s' for rows %d-%d\n", chunkName, rows.First, rows.Last)
+	return nil
+}
+
+// rerunRequested reports whether the chunk has to be regenerated for a row regardless of the cache:
+// its RERUN_COL checkbox is ticked or a RERUN command covers the row.
+// It also returns what requested the rerun, for logging.
+func (c ChunkSettings) rerunRequested(row map[string]interface{}) (bool, string) {
+	rowIndex, _ := row["RowIndex"].(int)
+	if c.RerunColumn != "" {
+		if ticked, err := strconv.ParseBool(strings.TrimSpace(fmt.Sprint(row[c.RerunColumn]))); err == nil && ticked {
+			return true, fmt.Sprintf("checkbox '%s'", c.RerunColumn)
+		}
+	}
+	for _, rows := range pendingReruns[c.Name] {
+		if rows.contains(rowIndex + 1) {
+			return true, "RERUN command"
+		}
+	}
+	return false, ""
+}
+
+// untickRerun clears the chunk's RERUN_COL checkbox on a row.
+func untickRerun(row map[string]interface{}, gptSettings ChunkSettings) {
+	if gptSettings.RerunColumn == "" {
+		return
+	}
+	if ticked, err := strconv.ParseBool(strings.TrimSpace(fmt.Sprint(row[gptSettings.RerunColumn]))); err != nil || !ticked {
+		return
+	}
+	rowIndex, _ := row["RowIndex"].(int)
+	vr := &sheets.ValueRange{
+		Values: [][]interface{}{{false}},
+	}
+	_, err := writeToSheetWithRateLimit(spreadsheetID, fmt.Sprintf("%v%d", columnLetterByName[gptSettings.RerunColumn], rowIndex+1), vr)
+	if err != nil {
+		log.Printf("Error updating Google Sheet: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// validationError is returned by requestCompletion when the response still fails validation after every attempt.
+type validationError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("response failed validation after %d attempts: %v", e.Attempts, e.Err)
+}
+
+// completionResult holds the validated output of a chunk's completion, with the model that produced it,
+// the tokens used, the time spent waiting for the API over every attempt and the tools the model called.
+type completionResult struct {
+	Values    []interface{}
+	Usage     openai.Usage
+	Model     string
+	Latency   time.Duration
+	ToolCalls []ToolCall
+}
+
+// newChatRequest builds the chat completion request for a chunk from its rendered messages.
+// The chunk's few-shot examples are sent as user/assistant pairs after the system message, followed by
+// the conversation turns of its MESSAGES rendered for the row, then the user message if there is one.
+// Chunks with an output schema are forced to answer through the structured output function, unless the chunk
+// enabled TOOLS: then the model chooses between calling a tool and answering.
+func newChatRequest(gptSettings ChunkSettings, row map[string]interface{}, systemMessage, userMessage string) openai.ChatCompletionRequest {
+	conversation := gptSettings.conversationMessages(row)
+	lastUserMessage := userMessage
+	for _, message := range conversation {
+		if strings.TrimSpace(userMessage) == "" && message.Role == openai.ChatMessageRoleUser {
+			lastUserMessage = message.Content
+		}
+	}
+
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: systemMessage,
+		},
+	}
+	messages = append(messages, gptSettings.fewShotMessages(lastUserMessage)...)
+	messages = append(messages, conversation...)
+	if strings.TrimSpace(userMessage) != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userMessage,
+		})
+	}
+
+	request := openai.ChatCompletionRequest{
+		Model:       gptSettings.model(),
+		Messages:    messages,
+		MaxTokens:   gptSettings.MaxTokens,
+		Temperature: float32(gptSettings.Temperature),
+	}
+	if gptSettings.OutputSchema != nil {
+		request.Functions = []openai.FunctionDefinition{gptSettings.OutputSchema.functionDefinition()}
+		request.FunctionCall = map[string]string{"name": structuredOutputFunctionName}
+	}
+	if len(gptSettings.Tools.Names) > 0 {
+		request.Functions = append(request.Functions, gptSettings.Tools.functionDefinitions()...)
+		request.FunctionCall = "auto"
+	}
+	return request
+}
+
+// withoutTools returns the request with the chunk's tools removed, so the model has to answer.
+func withoutTools(gptSettings ChunkSettings, request openai.ChatCompletionRequest) openai.ChatCompletionRequest {
+	request.Functions = nil
+	request.FunctionCall = nil
+	if gptSettings.OutputSchema != nil {
+		request.Functions = []openai.FunctionDefinition{gptSettings.OutputSchema.functionDefinition()}
+		request.FunctionCall = map[string]string{"name": structuredOutputFunctionName}
+	}
+	return request
+}
+
+// model returns the chunk's MODEL, or GPT-4 if it is not set.
+func (c ChunkSettings) model() string {
+	if c.Model != "" {
+		return c.Model
+	}
+	return openai.GPT4
+}
+
+// guardedIndex returns the index of PromptColTo among the chunk's destination columns.
+func (c ChunkSettings) guardedIndex() int {
+	for i, columnName := range c.destinationColumns() {
+		if columnName == c.PromptColTo {
+			return i
+		}
+	}
+	return 0
+}
+
+// requestCompletion sends a chat completion request for a chunk and turns the response into output values.
+// Chunks with an output schema have the function arguments validated against the schema.
+// Every value is run through the chunk's post-processors, then the PromptColTo value is checked against
+// the chunk's guardrails. When either check fails the model is shown what was wrong and re-asked
+// up to OutputRetries times. Calls to the chunk's TOOLS are run and their results sent back, for up to
+// TOOLS_MAX_TURNS rounds after which the model has to answer; they do not count as attempts.
+// The label identifies the row or group in log messages.
+// It returns the values in destination column order, a *validationError once attempts are exhausted,
+// or any error returned by the API.
+func requestCompletion(gptSettings ChunkSettings, request openai.ChatCompletionRequest, label string) (*completionResult, error) {
+	client := openai.NewClient(os.Getenv("OPENAI_SECRET_KEY"))
+	result := &completionResult{Model: request.Model}
+	toolTurns := 0
+
+	for attempt := 0; ; attempt++ {
+		if err := gptLimiter.Wait(context.Background()); err != nil {
+			log.Printf("[GPT] rate limit error: %v", err)
+			return nil, err
+		}
+
+		start := time.Now()
+		resp, err := client.CreateChatCompletion(context.Background(), request)
+		result.Latency += time.Since(start)
+		if err != nil {
+			log.Printf("[ERROR] getting GPT response: %v", err)
+			return nil, err
+		}
+		if resp.Model != "" {
+			result.Model = resp.Model
+		}
+		result.Usage.PromptTokens += resp.Usage.PromptTokens
+		result.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		result.Usage.TotalTokens += resp.Usage.TotalTokens
+
+		if len(resp.Choices) <= 0 {
+			log.Printf("No choices in the response")
+			return nil, fmt.Errorf("no choices in the response")
+		}
+
+		message := resp.Choices[0].Message
+		if call := message.FunctionCall; call != nil && call.Name != structuredOutputFunctionName && len(gptSettings.Tools.Names) > 0 {
+			log.Printf("%s '%s' called %s(%s)", label, gptSettings.Name, call.Name, call.Arguments)
+			result.ToolCalls = append(result.ToolCalls, ToolCall{Name: call.Name, Arguments: call.Arguments})
+			request.Messages = append(request.Messages, message, openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleFunction,
+				Name:    call.Name,
+				Content: gptSettings.Tools.callTool(call),
+			})
+			toolTurns++
+			if toolTurns >= gptSettings.Tools.maxTurns() {
+				log.Printf("%s '%s' reached %d tool turns", label, gptSettings.Name, toolTurns)
+				request = withoutTools(gptSettings, request)
+			}
+			// A tool call is not an answer, so it doesn't use up an attempt
+			attempt--
+			continue
+		}
+		values, err := gptSettings.validateMessage(message)
+		if err == nil {
+			result.Values = values
+			return result, nil
+		}
+
+		if attempt >= gptSettings.OutputRetries {
+			log.Printf("%s response for '%s' failed validation: %v", label, gptSettings.Name, err)
+			return result, &validationError{Attempts: attempt + 1, Err: err}
+		}
+		log.Printf("%s response for '%s' failed validation, retrying: %v", label, gptSettings.Name, err)
+
+		// Show the model its invalid answer and what was wrong with it
+		reask := fmt.Sprintf("Your previous answer was invalid: %v. Answer again.", err)
+		if gptSettings.OutputSchema != nil {
+			reask = fmt.Sprintf("Your previous answer was invalid: %v. Call %s again with arguments that match the schema.", err, structuredOutputFunctionName)
+		}
+		request.Messages = append(request.Messages, message, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: reask,
+		})
+	}
+}
+
+// validateMessage turns a response message into output values in destination column order: the function
+// arguments checked against the output schema, or the message content. Every value is post-processed, then the
+// PromptColTo value is checked against the chunk's guardrails.
+// It returns an error describing what was wrong if the message is invalid.
+func (c ChunkSettings) validateMessage(message openai.ChatCompletionMessage) ([]interface{}, error) {
+	var values []interface{}
+	if c.OutputSchema == nil {
+		values = []interface{}{message.Content}
+	} else {
+		var err error
+		values, err = c.OutputSchema.parseResponse(message)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, value := range values {
+		values[i] = postProcess(c.PostProcess, value)
+	}
+
+	guardedIndex := c.guardedIndex()
+	guarded, err := c.Guardrails.validate(values[guardedIndex])
+	if err != nil {
+		return nil, err
+	}
+	values[guardedIndex] = guarded
+	return values, nil
+}
+
+// fallbackValues returns the values written when a response failed validation and the chunk has a fallback value:
+// the fallback in the PromptColTo column and empty values elsewhere. It returns nil if there is no fallback.
+func (c ChunkSettings) fallbackValues() []interface{} {
+	if c.Guardrails.Fallback == nil {
+		return nil
+	}
+	values := make([]interface{}, len(c.destinationColumns()))
+	for i := range values {
+		values[i] = ""
+	}
+	values[c.guardedIndex()] = *c.Guardrails.Fallback
+	return values
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ChatTurn is one message of a chunk's MESSAGES list: a role and the column, or template, its content comes from.
+type ChatTurn struct {
+	Role     string
+	Template string
+}
+
+// parseMessages parses a MESSAGES value such as "user:Question1,assistant:Answer1,user:Followup".
+// Each turn names a column, or gives a template when it contains a token such as "{Question1} ({Language})".
+// It returns an error if a turn has no role or an unknown one.
+func parseMessages(value string) ([]ChatTurn, error) {
+	var turns []ChatTurn
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		role, source, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("error: MESSAGES turn %q is not role:column", item)
+		}
+		role = strings.ToLower(strings.TrimSpace(role))
+		switch role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+		default:
+			return nil, fmt.Errorf("error: MESSAGES role must be system, user or assistant. It is %s", role)
+		}
+		source = strings.TrimSpace(source)
+		if !strings.Contains(source, "{") {
+			source = "{" + source + "}"
+		}
+		turns = append(turns, ChatTurn{Role: role, Template: source})
+	}
+	return turns, nil
+}
+
+// hasPrompts reports whether the chunk has a system message and something to send after it:
+// a user message or a conversation.
+func (c ChunkSettings) hasPrompts() bool {
+	return c.SystemMessage != "" && (c.UserMessage != "" || len(c.Messages) > 0)
+}
+
+// conversationMessages renders the chunk's MESSAGES turns for a row. Turns that render empty are left out,
+// so rows can hold conversations of different lengths.
+func (c ChunkSettings) conversationMessages(row map[string]interface{}) []openai.ChatCompletionMessage {
+	var messages []openai.ChatCompletionMessage
+	for _, turn := range c.Messages {
+		content := renderTemplate(turn.Template, row)
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		messages = append(messages, openai.ChatCompletionMessage{Role: turn.Role, Content: content})
+	}
+	return messages
+}
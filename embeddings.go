@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// embedTexts returns the embeddings of texts, in order, waiting for the GPT rate limiter first.
+// It returns an error if the API call failed.
+func embedTexts(texts []string) ([][]float32, error) {
+	if err := gptLimiter.Wait(context.Background()); err != nil {
+		return nil, err
+	}
+
+	client := openai.NewClient(os.Getenv("OPENAI_SECRET_KEY"))
+	resp, err := client.CreateEmbeddings(context.Background(), openai.EmbeddingRequest{
+		Input: texts,
+		Model: openai.AdaEmbeddingV2,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create embeddings: %v", err)
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Data))
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d is out of range", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// cosineSimilarity returns the cosine similarity of two vectors, or 0 if either is empty or zero.
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		if i >= len(b) {
+			break
+		}
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scoring methods for VARx_EVAL_METHOD.
+const (
+	evalExact     = "exact"
+	evalRegex     = "regex"
+	evalNumeric   = "numeric"
+	evalEmbedding = "embedding"
+	evalJudge     = "judge"
+)
+
+// defaultEvalTab is the tab eval results are appended to when VARx_EVAL_TAB is not set.
+const defaultEvalTab = "Eval"
+
+// evalTabHeader is written to a newly created eval tab.
+var evalTabHeader = []interface{}{"Timestamp", "Chunk", "Definition", "Row", "Method", "Expected", "Output", "Score", "Pass", "Tokens"}
+
+// EvalSettings holds how a chunk's outputs are scored against the golden answers in its EXPECTED_COL.
+type EvalSettings struct {
+	ExpectedColumn string
+	Method         string
+	Tolerance      float64
+	Threshold      *float64
+	Judge          string
+	Tab            string
+}
+
+// parseEvalSetting applies a VARx_EXPECTED_COL or VARx_EVAL_* setting.
+// It returns true if the property is an eval setting, and an error if its value is invalid.
+func parseEvalSetting(eval *EvalSettings, varProp string, varValue string) (bool, error) {
+	switch varProp {
+	case "EXPECTED_COL":
+		eval.ExpectedColumn = strings.TrimSpace(varValue)
+	case "EVAL_METHOD":
+		method := strings.ToLower(strings.TrimSpace(varValue))
+		switch method {
+		case evalExact, evalRegex, evalNumeric, evalEmbedding, evalJudge:
+			eval.Method = method
+		default:
+			return true, fmt.Errorf("error: EVAL_METHOD must be exact, regex, numeric, embedding or judge. It is %s", varValue)
+		}
+	case "EVAL_TOLERANCE":
+		tolerance, err := strconv.ParseFloat(strings.TrimSpace(varValue), 64)
+		if err != nil {
+			return true, fmt.Errorf("error: EVAL_TOLERANCE is not a float64. It is a %s", varValue)
+		}
+		eval.Tolerance = tolerance
+	case "EVAL_THRESHOLD":
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(varValue), 64)
+		if err != nil {
+			return true, fmt.Errorf("error: EVAL_THRESHOLD is not a float64. It is a %s", varValue)
+		}
+		eval.Threshold = &threshold
+	case "EVAL_JUDGE":
+		eval.Judge = strings.TrimSpace(varValue)
+	case "EVAL_TAB":
+		eval.Tab = strings.TrimSpace(varValue)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// method returns the scoring method, exact match by default.
+func (e EvalSettings) method() string {
+	if e.Method == "" {
+		return evalExact
+	}
+	return e.Method
+}
+
+// threshold returns the score an output needs to pass: EVAL_THRESHOLD if set,
+// 0.85 for embedding similarity, 0.5 for a judge and 1 otherwise.
+func (e EvalSettings) threshold() float64 {
+	if e.Threshold != nil {
+		return *e.Threshold
+	}
+	switch e.method() {
+	case evalEmbedding:
+		return 0.85
+	case evalJudge:
+		return 0.5
+	}
+	return 1
+}
+
+// tab returns the tab eval results are appended to.
+func (e EvalSettings) tab() string {
+	if e.Tab == "" {
+		return defaultEvalTab
+	}
+	return e.Tab
+}
+
+var judgeNumberPattern = regexp.MustCompile(`-?\d+(?:\.\d+)?`)
+
+// parseJudgeScore turns a judge's answer into a score between 0 and 1. It accepts PASS/FAIL, YES/NO,
+// CORRECT/INCORRECT and numbers, where scores above 1 are read as out of 10 or out of 100.
+// It returns an error if the answer contains no score.
+func parseJudgeScore(answer string) (float64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(answer))
+	for _, word := range []string{"INCORRECT", "FAIL", "NO"} {
+		if strings.HasPrefix(upper, word) {
+			return 0, nil
+		}
+	}
+	for _, word := range []string{"CORRECT", "PASS", "YES"} {
+		if strings.HasPrefix(upper, word) {
+			return 1, nil
+		}
+	}
+
+	match := judgeNumberPattern.FindString(upper)
+	if match == "" {
+		return 0, fmt.Errorf("judge answer %q contains no score", answer)
+	}
+	score, _ := strconv.ParseFloat(match, 64)
+	switch {
+	case score > 10:
+		score /= 100
+	case score > 1:
+		score /= 10
+	}
+	return math.Max(0, math.Min(1, score)), nil
+}
+
+// scoreOutput scores an output against the expected answer with the chunk's EVAL_METHOD. A judge chunk is rendered
+// with the row plus {EXPECTED} and {OUTPUT} tokens.
+// It returns the score between 0 and 1, the tokens spent scoring, or an error if the output could not be scored.
+func scoreOutput(gptSettings ChunkSettings, row map[string]interface{}, expected string, output string) (float64, int, error) {
+	switch gptSettings.Eval.method() {
+	case evalRegex:
+		pattern, err := regexp.Compile(expected)
+		if err != nil {
+			return 0, 0, fmt.Errorf("expected value %q is not a regular expression: %v", expected, err)
+		}
+		if pattern.MatchString(output) {
+			return 1, 0, nil
+		}
+		return 0, 0, nil
+	case evalNumeric:
+		want, ok := toNumber(strings.TrimSpace(expected))
+		if !ok {
+			return 0, 0, fmt.Errorf("expected value %q is not a number", expected)
+		}
+		got, ok := toNumber(strings.TrimSpace(output))
+		if !ok || math.Abs(got-want) > gptSettings.Eval.Tolerance {
+			return 0, 0, nil
+		}
+		return 1, 0, nil
+	case evalEmbedding:
+		embeddings, err := embedTexts([]string{expected, output})
+		if err != nil {
+			return 0, 0, err
+		}
+		return cosineSimilarity(embeddings[0], embeddings[1]), 0, nil
+	case evalJudge:
+		judge, ok := gptSettingsByName[gptSettings.Eval.Judge]
+		if !ok {
+			return 0, 0, fmt.Errorf("EVAL_JUDGE chunk %q does not exist", gptSettings.Eval.Judge)
+		}
+		judgeRow := make(map[string]interface{}, len(row)+2)
+		for key, value := range row {
+			judgeRow[key] = value
+		}
+		judgeRow["EXPECTED"] = expected
+		judgeRow["OUTPUT"] = output
+
+		request := newChatRequest(judge, judgeRow, renderTemplate(judge.SystemMessage, judgeRow), renderTemplate(judge.UserMessage, judgeRow))
+		result, err := requestCompletion(judge, request, fmt.Sprintf("Eval row #%d", row["RowIndex"]))
+		if err != nil {
+			return 0, 0, err
+		}
+		score, err := parseJudgeScore(fmt.Sprint(result.Values[judge.guardedIndex()]))
+		return score, result.Usage.TotalTokens, err
+	}
+
+	if strings.TrimSpace(output) == strings.TrimSpace(expected) {
+		return 1, 0, nil
+	}
+	return 0, 0, nil
+}
+
+// evalSummary is the aggregate result of evaluating a chunk.
+type evalSummary struct {
+	Chunk      string
+	Definition string
+	Rows       int
+	Passed     int
+	Errors     int
+	TotalScore float64
+	Tokens     int
+}
+
+// String formats the summary for the eval tab and the command line.
+func (s evalSummary) String() string {
+	if s.Rows == 0 {
+		return fmt.Sprintf("%s: no rows with an expected value", s.Chunk)
+	}
+	return fmt.Sprintf("%s: %d/%d passed (%.1f%%), mean score %.3f, %d errors, %d tokens",
+		s.Chunk, s.Passed, s.Rows, 100*float64(s.Passed)/float64(s.Rows), summaryScore(s), s.Errors, s.Tokens)
+}
+
+// runEval runs every chunk with an EXPECTED_COL, or only the named ones, over the rows of the watched sheet that have
+// an expected value, scores each output and appends per-row scores and a summary row to the chunk's eval tab.
+// Outputs are not written to the sheet.
+// It returns the summaries, or an error if the sheet could not be read or a named chunk cannot be evaluated.
+func runEval(chunkNames []string) ([]evalSummary, error) {
+	resp, err := getSheetValuesWithSemaphore(spreadsheetID, allSettings["GLOBAL"]["SHEET_NAME"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sheet: %v", err)
+	}
+	if len(resp.Values) == 0 {
+		return nil, fmt.Errorf("the sheet is empty")
+	}
+	sheetRows = resp.Values
+	indexColumns(resp.Values[0])
+	if err := refreshLookupTabs(); err != nil {
+		log.Printf("Error refreshing lookup tabs: %v", err)
+	}
+
+	if len(chunkNames) == 0 {
+		for name, gptSettings := range gptSettingsByName {
+			if gptSettings.Eval.ExpectedColumn != "" {
+				chunkNames = append(chunkNames, name)
+			}
+		}
+		sort.Strings(chunkNames)
+	}
+	if len(chunkNames) == 0 {
+		return nil, fmt.Errorf("no chunk has an EXPECTED_COL")
+	}
+
+	var summaries []evalSummary
+	for _, name := range chunkNames {
+		gptSettings, ok := gptSettingsByName[name]
+		if !ok {
+			return summaries, fmt.Errorf("unknown chunk %q", name)
+		}
+		if gptSettings.Eval.ExpectedColumn == "" {
+			return summaries, fmt.Errorf("chunk %q has no EXPECTED_COL", name)
+		}
+		if gptSettings.Mode != "" || gptSettings.isTable() {
+			return summaries, fmt.Errorf("chunk %q writes outside its row and cannot be evaluated", name)
+		}
+		summary, err := evalChunk(gptSettings, resp.Values)
+		if err != nil {
+			return summaries, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// evalChunk evaluates one chunk over the rows that have an expected value and writes the results to its eval tab.
+// Chunks with STEPS run every step as they do in production, see runSteps. Responses that fail validation
+// score 0 and count as errors.
+// It returns the summary, or an error if the eval tab could not be written.
+func evalChunk(gptSettings ChunkSettings, currentRows [][]interface{}) (evalSummary, error) {
+	summary := evalSummary{Chunk: gptSettings.Name, Definition: gptSettings.definitionHash()}
+	method := gptSettings.Eval.method()
+	threshold := gptSettings.Eval.threshold()
+	timestamp := time.Now().In(settingsLocation()).Format(time.RFC3339)
+
+	var results [][]interface{}
+	for rowIndex := 1; rowIndex < len(currentRows); rowIndex++ {
+		row := rowMap(currentRows, rowIndex)
+		expected := strings.TrimSpace(fmt.Sprint(row[gptSettings.Eval.ExpectedColumn]))
+		if row[gptSettings.Eval.ExpectedColumn] == nil || expected == "" {
+			continue
+		}
+		if !gptSettings.Filter.allows(gptSettings.Name, row) {
+			continue
+		}
+		summary.Rows++
+
+		var result *completionResult
+		var err error
+		if len(gptSettings.Steps) > 0 {
+			var steps *stepsResult
+			steps, err = runSteps(row, rowIndex, gptSettings)
+			result = &steps.completionResult
+		} else {
+			request := newChatRequest(gptSettings, row, renderTemplate(gptSettings.SystemMessage, row), renderTemplate(gptSettings.UserMessage, row))
+			result, err = requestCompletion(gptSettings, request, fmt.Sprintf("Eval row #%d", rowIndex))
+		}
+		tokens := 0
+		if result != nil {
+			tokens = result.Usage.TotalTokens
+		}
+		var output string
+		var score float64
+		if invalid, ok := err.(*validationError); ok {
+			summary.Errors++
+			output = errorStatusPrefix + invalid.Err.Error()
+		} else if err != nil {
+			summary.Errors++
+			output = errorStatusPrefix + err.Error()
+		} else {
+			output = fmt.Sprint(result.Values[gptSettings.guardedIndex()])
+			var judgeTokens int
+			score, judgeTokens, err = scoreOutput(gptSettings, row, expected, output)
+			tokens += judgeTokens
+			if err != nil {
+				summary.Errors++
+				log.Printf("Error scoring row #%d of '%s': %v", rowIndex, gptSettings.Name, err)
+			}
+		}
+
+		passed := score >= threshold
+		if passed {
+			summary.Passed++
+		}
+		summary.TotalScore += score
+		summary.Tokens += tokens
+		results = append(results, []interface{}{
+			timestamp, gptSettings.Name, summary.Definition, rowIndex + 1, method, historyText(expected), historyText(output), score, passed, tokens,
+		})
+		log.Printf("Eval row #%d of '%s' scored %.3f\n", rowIndex, gptSettings.Name, score)
+	}
+
+	results = append(results, []interface{}{timestamp, gptSettings.Name, summary.Definition, "SUMMARY", method, "", summary.String(), summaryScore(summary), "", summary.Tokens})
+
+	title := gptSettings.Eval.tab()
+	defer lockTab(title)()
+	if _, err := ensureSheet(title, evalTabHeader); err != nil {
+		return summary, err
+	}
+	if _, err := appendToSheetWithRateLimit(title, results); err != nil {
+		return summary, fmt.Errorf("unable to append to %s: %v", title, err)
+	}
+	return summary, nil
+}
+
+// summaryScore returns the mean score of a summary, or 0 if no rows were evaluated.
+func summaryScore(summary evalSummary) float64 {
+	if summary.Rows == 0 {
+		return 0
+	}
+	return summary.TotalScore / float64(summary.Rows)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Example selection modes for VARx_EXAMPLES_SELECT.
+const (
+	examplesFirst   = "first"
+	examplesSimilar = "similar"
+)
+
+// ExampleSettings holds where a chunk's few-shot examples come from and how many are sent.
+type ExampleSettings struct {
+	Tab          string
+	Max          int
+	Select       string
+	OutputColumn string
+}
+
+// parseExampleSetting applies a VARx_EXAMPLES_* setting.
+// It returns true if the property is an examples setting, and an error if its value is invalid.
+func parseExampleSetting(examples *ExampleSettings, varProp string, varValue string) (bool, error) {
+	switch varProp {
+	case "EXAMPLES_TAB":
+		examples.Tab = sheetTitle(strings.TrimSpace(varValue))
+	case "EXAMPLES_MAX":
+		max, err := strconv.Atoi(strings.TrimSpace(varValue))
+		if err != nil {
+			return true, fmt.Errorf("error: EXAMPLES_MAX is not an int. It is a %s", varValue)
+		}
+		examples.Max = max
+	case "EXAMPLES_SELECT":
+		mode := strings.ToLower(strings.TrimSpace(varValue))
+		if mode != examplesFirst && mode != examplesSimilar {
+			return true, fmt.Errorf("error: EXAMPLES_SELECT must be first or similar. It is %s", varValue)
+		}
+		examples.Select = mode
+	case "EXAMPLES_OUTPUT_COL":
+		examples.OutputColumn = strings.TrimSpace(varValue)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// fewShotExample is an example rendered as a user message and the answer expected for it.
+type fewShotExample struct {
+	User      string
+	Assistant string
+}
+
+// exampleEmbeddings caches the embeddings of rendered example messages, keyed by text.
+var exampleEmbeddings = make(map[string][]float32)
+var exampleEmbeddingsMutex = &sync.Mutex{}
+
+// loadExamples renders the rows of the chunk's EXAMPLES_TAB, read from the lookup cache. Each row is rendered with
+// the chunk's USER_MESSAGE as if it were a row of the watched sheet, and its output column is the answer:
+// EXAMPLES_OUTPUT_COL, the column named like PROMPT_COL_TO, or the last column. Rows without an answer are skipped.
+func (c ChunkSettings) loadExamples() []fewShotExample {
+	lookupCacheMutex.RLock()
+	values := lookupCache[c.Examples.Tab]
+	lookupCacheMutex.RUnlock()
+	if len(values) < 2 {
+		return nil
+	}
+
+	header := make([]string, len(values[0]))
+	outputIndex := len(values[0]) - 1
+	for i, cell := range values[0] {
+		header[i] = fmt.Sprint(cell)
+		if c.Examples.OutputColumn != "" && header[i] == c.Examples.OutputColumn {
+			outputIndex = i
+		} else if c.Examples.OutputColumn == "" && header[i] == c.PromptColTo {
+			outputIndex = i
+		}
+	}
+
+	var examples []fewShotExample
+	for _, values := range values[1:] {
+		if outputIndex >= len(values) {
+			continue
+		}
+		answer := strings.TrimSpace(fmt.Sprint(values[outputIndex]))
+		if answer == "" {
+			continue
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, columnName := range header {
+			if i < len(values) {
+				row[columnName] = values[i]
+			} else {
+				row[columnName] = ""
+			}
+		}
+		examples = append(examples, fewShotExample{User: renderTemplate(c.UserMessage, row), Assistant: answer})
+	}
+	return examples
+}
+
+// selectExamples picks up to EXAMPLES_MAX examples: the first ones, or with EXAMPLES_SELECT=similar the ones whose
+// rendered message is most similar to the request's by embedding, most similar last.
+// It falls back to the first examples if the embeddings could not be created.
+func (c ChunkSettings) selectExamples(examples []fewShotExample, userMessage string) []fewShotExample {
+	if c.Examples.Max <= 0 || len(examples) <= c.Examples.Max {
+		return examples
+	}
+	if c.Examples.Select != examplesSimilar {
+		return examples[:c.Examples.Max]
+	}
+
+	exampleEmbeddingsMutex.Lock()
+	var missing []string
+	for _, example := range examples {
+		if _, ok := exampleEmbeddings[example.User]; !ok {
+			missing = append(missing, example.User)
+		}
+	}
+	exampleEmbeddingsMutex.Unlock()
+
+	embeddings, err := embedTexts(append(missing, userMessage))
+	if err != nil {
+		log.Printf("Error selecting examples of '%s': %v", c.Name, err)
+		return examples[:c.Examples.Max]
+	}
+	query := embeddings[len(missing)]
+
+	exampleEmbeddingsMutex.Lock()
+	for i, text := range missing {
+		exampleEmbeddings[text] = embeddings[i]
+	}
+	similarities := make([]float64, len(examples))
+	for i, example := range examples {
+		similarities[i] = cosineSimilarity(exampleEmbeddings[example.User], query)
+	}
+	exampleEmbeddingsMutex.Unlock()
+
+	order := make([]int, len(examples))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return similarities[order[a]] > similarities[order[b]] })
+
+	selected := make([]fewShotExample, c.Examples.Max)
+	for i := range selected {
+		selected[len(selected)-1-i] = examples[order[i]]
+	}
+	return selected
+}
+
+// fewShotMessages returns the chunk's examples as alternating user and assistant messages,
+// or nil if the chunk has no EXAMPLES_TAB.
+func (c ChunkSettings) fewShotMessages(userMessage string) []openai.ChatCompletionMessage {
+	if c.Examples.Tab == "" {
+		return nil
+	}
+	examples := c.selectExamples(c.loadExamples(), userMessage)
+	messages := make([]openai.ChatCompletionMessage, 0, 2*len(examples))
+	for _, example := range examples {
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: example.User},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: example.Assistant})
+	}
+	return messages
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// chunkModeExpand is the VARx_MODE of chunks whose response is a list written as new rows of OUTPUT_TAB.
+const chunkModeExpand = "EXPAND"
+
+// expandTabHeader is written to a newly created expansion tab. Source holds the key of the row that produced the item.
+var expandTabHeader = []interface{}{"Source", "Chunk", "Item #", "Item"}
+
+var listMarkerPattern = regexp.MustCompile(`^\s*(?:[-*+•]|\d+[.)]|\[\s*[xX ]?\s*\])\s+`)
+
+// sourceKey returns the value that identifies a row in the rows generated from it:
+// the chunk's KEY_COL value if set, otherwise the row number.
+func (c ChunkSettings) sourceKey(row map[string]interface{}, rowIndex int) string {
+	if c.KeyColumn != "" {
+		if key := strings.TrimSpace(fmt.Sprint(row[c.KeyColumn])); key != "" && row[c.KeyColumn] != nil {
+			return key
+		}
+	}
+	return fmt.Sprintf("Row %d", rowIndex+1)
+}
+
+// parseListItems splits a response into list items. A JSON array is used as is,
+// otherwise every non-empty line is an item with its bullet or numbering removed.
+func parseListItems(output string) []string {
+	trimmed := strings.TrimSpace(stripMarkdown(output))
+
+	var array []interface{}
+	if err := json.Unmarshal([]byte(trimmed), &array); err == nil {
+		items := make([]string, 0, len(array))
+		for _, item := range array {
+			var s string
+			switch v := item.(type) {
+			case string:
+				s = v
+			default:
+				b, _ := json.Marshal(v)
+				s = string(b)
+			}
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		return items
+	}
+
+	var items []string
+	for _, line := range strings.Split(trimmed, "\n") {
+		line = strings.TrimSpace(listMarkerPattern.ReplaceAllString(line, ""))
+		if line != "" {
+			items = append(items, line)
+		}
+	}
+	return items
+}
+
+// runExpansionOnRow runs an EXPAND chunk on a row: the response is parsed into items, the rows previously generated
+// by the chunk for the same source row are deleted from OUTPUT_TAB, and one row per item is appended.
+// It returns an error if an error occurred.
+func runExpansionOnRow(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings) error {
+	systemMessage := renderTemplate(gptSettings.SystemMessage, row)
+	userMessage := renderTemplate(gptSettings.UserMessage, row)
+	request := newChatRequest(gptSettings, row, systemMessage, userMessage)
+
+	result, err := requestCompletion(gptSettings, request, fmt.Sprintf("Row #%d", rowIndex))
+	if err != nil {
+		return err
+	}
+
+	items := parseListItems(fmt.Sprint(result.Values[gptSettings.guardedIndex()]))
+	if gptSettings.MaxItems > 0 && len(items) > gptSettings.MaxItems {
+		items = items[:gptSettings.MaxItems]
+	}
+	key := gptSettings.sourceKey(row, rowIndex)
+
+	defer lockTab(gptSettings.OutputTab)()
+
+	sheetID, err := ensureSheet(gptSettings.OutputTab, expandTabHeader)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteGeneratedRows(gptSettings.OutputTab, sheetID, key, gptSettings.Name); err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		log.Printf("Row #%d response for '%s' contained no items\n", rowIndex, gptSettings.Name)
+		rememberDefinition(rowIndex, gptSettings)
+		return nil
+	}
+
+	rows := make([][]interface{}, len(items))
+	for i, item := range items {
+		rows[i] = []interface{}{key, gptSettings.Name, i + 1, item}
+	}
+	if _, err := appendToSheetWithRateLimit(gptSettings.OutputTab, rows); err != nil {
+		return fmt.Errorf("unable to append to %s: %v", gptSettings.OutputTab, err)
+	}
+	log.Printf("Wrote %d item(s) of row #%d to %s\n", len(items), rowIndex, gptSettings.OutputTab)
+	rememberDefinition(rowIndex, gptSettings)
+
+	return nil
+}
+
+// deleteGeneratedRows deletes the rows of a tab whose Source and Chunk columns match, bottom-up so the
+// indexes of the remaining rows stay valid.
+// It returns an error if the tab could not be read or updated.
+func deleteGeneratedRows(title string, sheetID int64, key string, chunkName string) error {
+	resp, err := readFromSheetWithRateLimit(spreadsheetID, fmt.Sprintf("'%s'!A:B", title))
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", title, err)
+	}
+
+	var matches []int
+	for i, existing := range resp.Values {
+		if i == 0 || len(existing) < 2 {
+			continue
+		}
+		if fmt.Sprint(existing[0]) == key && fmt.Sprint(existing[1]) == chunkName {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(matches)))
+
+	requests := make([]*sheets.Request, len(matches))
+	for i, rowIndex := range matches {
+		requests[i] = &sheets.Request{
+			DeleteDimension: &sheets.DeleteDimensionRequest{
+				Range: &sheets.DimensionRange{
+					SheetId:    sheetID,
+					Dimension:  "ROWS",
+					StartIndex: int64(rowIndex),
+					EndIndex:   int64(rowIndex + 1),
+				},
+			},
+		}
+	}
+
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Do()
+	if err != nil {
+		return fmt.Errorf("unable to delete previous rows from %s: %v", title, err)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Ratings a reviewer can give in a chunk's FEEDBACK_COL. Anything that is not an approval or a rejection
+// is taken as a corrected answer.
+const (
+	feedbackApproved  = "approved"
+	feedbackRejected  = "rejected"
+	feedbackCorrected = "corrected"
+)
+
+var feedbackApprovals = []string{"👍", "+1", "good", "yes", "ok", "approved", "approve", "correct"}
+var feedbackRejections = []string{"👎", "-1", "bad", "no", "rejected", "reject", "wrong"}
+
+// Sample is a generated output kept with the prompts that produced it and the feedback it got.
+type Sample struct {
+	Chunk         string            `json:"chunk"`
+	Row           int               `json:"row"`
+	SystemMessage string            `json:"system"`
+	Turns         []fineTuneMessage `json:"turns,omitempty"`
+	UserMessage   string            `json:"user"`
+	Output        string            `json:"output"`
+	Model         string            `json:"model"`
+	Definition    string            `json:"definition"`
+	Timestamp     string            `json:"timestamp"`
+	Rating        string            `json:"rating,omitempty"`
+	Correction    string            `json:"correction,omitempty"`
+}
+
+// feedbackSeen maps "chunk:row" to the last feedback value collected, so unchanged feedback is not read again.
+var feedbackSeen = make(map[string]string)
+var feedbackSeenMutex = &sync.Mutex{}
+
+// sampleKey returns the Redis key of the sample of a chunk on a row.
+func sampleKey(chunkName string, rowIndex int) string {
+	return fmt.Sprintf("sample:%s:%d", chunkName, rowIndex)
+}
+
+// samplesKey returns the Redis key of the set of a chunk's sample keys.
+func samplesKey(chunkName string) string {
+	return fmt.Sprintf("samples:%s", chunkName)
+}
+
+// classifyFeedback returns the rating of a feedback value, and the corrected answer if it is one.
+func classifyFeedback(value string) (string, string) {
+	trimmed := strings.TrimSpace(value)
+	lower := strings.ToLower(trimmed)
+	for _, approval := range feedbackApprovals {
+		if lower == approval {
+			return feedbackApproved, ""
+		}
+	}
+	for _, rejection := range feedbackRejections {
+		if lower == rejection {
+			return feedbackRejected, ""
+		}
+	}
+	return feedbackCorrected, trimmed
+}
+
+// sampleOutput returns the assistant answer of a sample: the PromptColTo value, or a JSON object of every
+// destination column for chunks with an output schema.
+func sampleOutput(gptSettings ChunkSettings, values []interface{}) string {
+	if gptSettings.OutputSchema == nil {
+		return fmt.Sprint(values[gptSettings.guardedIndex()])
+	}
+	object := make(map[string]interface{}, len(values))
+	for i, columnName := range gptSettings.destinationColumns() {
+		object[columnName] = values[i]
+	}
+	b, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Sprint(values)
+	}
+	return string(b)
+}
+
+// recordSample stores a chunk's output on a row with the prompts that produced it, replacing the previous sample.
+// Feedback given on the previous output no longer applies, so the row's FEEDBACK_COL is cleared.
+func recordSample(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, systemMessage, userMessage, model string, values []interface{}) {
+	if gptSettings.FeedbackColumn == "" {
+		return
+	}
+	sample := Sample{
+		Chunk:         gptSettings.Name,
+		Row:           rowIndex + 1,
+		SystemMessage: systemMessage,
+		UserMessage:   userMessage,
+		Turns:         conversationTurns(gptSettings, row),
+		Output:        sampleOutput(gptSettings, values),
+		Model:         model,
+		Definition:    gptSettings.definitionHash(),
+		Timestamp:     time.Now().Format(time.RFC3339),
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		log.Printf("Error encoding sample: %v", err)
+		return
+	}
+	key := sampleKey(gptSettings.Name, rowIndex)
+	if err := redisClient.Set(key, string(b), 0).Err(); err != nil {
+		log.Printf("Error setting value in Redis: %v", err)
+		return
+	}
+	if err := redisClient.SAdd(samplesKey(gptSettings.Name), key).Err(); err != nil {
+		log.Printf("Error adding value in Redis: %v", err)
+	}
+
+	feedbackSeenMutex.Lock()
+	feedbackSeen[fmt.Sprintf("%s:%d", gptSettings.Name, rowIndex)] = ""
+	feedbackSeenMutex.Unlock()
+
+	if feedback := fmt.Sprint(row[gptSettings.FeedbackColumn]); row[gptSettings.FeedbackColumn] != nil && feedback != "" {
+		vr := &sheets.ValueRange{
+			Values: [][]interface{}{{""}},
+		}
+		_, err := writeToSheetWithRateLimit(spreadsheetID, fmt.Sprintf("%v%d", columnLetterByName[gptSettings.FeedbackColumn], rowIndex+1), vr)
+		if err != nil {
+			log.Printf("Error updating Google Sheet: %v", err)
+		}
+	}
+}
+
+// collectFeedback stores the value of a row's FEEDBACK_COL with the chunk's sample for the row when it changed.
+func collectFeedback(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings) {
+	feedback := strings.TrimSpace(fmt.Sprint(row[gptSettings.FeedbackColumn]))
+	if row[gptSettings.FeedbackColumn] == nil {
+		feedback = ""
+	}
+	seenKey := fmt.Sprintf("%s:%d", gptSettings.Name, rowIndex)
+	feedbackSeenMutex.Lock()
+	seen, ok := feedbackSeen[seenKey]
+	feedbackSeen[seenKey] = feedback
+	feedbackSeenMutex.Unlock()
+	if (ok && seen == feedback) || (!ok && feedback == "") {
+		return
+	}
+
+	key := sampleKey(gptSettings.Name, rowIndex)
+	value, err := redisClient.Get(key).Result()
+	if err == redis.Nil {
+		return
+	} else if err != nil {
+		log.Printf("Error getting value from Redis: %v", err)
+		return
+	}
+	var sample Sample
+	if err := json.Unmarshal([]byte(value), &sample); err != nil {
+		log.Printf("Error decoding sample: %v", err)
+		return
+	}
+
+	sample.Rating, sample.Correction = "", ""
+	if feedback != "" {
+		sample.Rating, sample.Correction = classifyFeedback(feedback)
+	}
+	if sample.Rating == feedbackCorrected && sample.Correction == sample.Output {
+		sample.Rating, sample.Correction = feedbackApproved, ""
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		log.Printf("Error encoding sample: %v", err)
+		return
+	}
+	if err := redisClient.Set(key, string(b), 0).Err(); err != nil {
+		log.Printf("Error setting value in Redis: %v", err)
+		return
+	}
+	log.Printf("Row #%d feedback for '%s': %s\n", rowIndex, gptSettings.Name, sample.Rating)
+}
+
+// fineTuneMessage is a message of an OpenAI chat fine-tuning example.
+type fineTuneMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// conversationTurns returns the chunk's MESSAGES turns rendered for a row, as stored with a sample.
+func conversationTurns(gptSettings ChunkSettings, row map[string]interface{}) []fineTuneMessage {
+	var turns []fineTuneMessage
+	for _, message := range gptSettings.conversationMessages(row) {
+		turns = append(turns, fineTuneMessage{Role: message.Role, Content: message.Content})
+	}
+	return turns
+}
+
+// exportFineTune writes the approved and corrected samples of every chunk with a FEEDBACK_COL, or only the named
+// ones, to a file as OpenAI chat fine-tuning JSONL. Corrected samples use the correction as the answer.
+// It returns the number of examples written, or an error if the samples could not be read or the file written.
+func exportFineTune(path string, chunkNames []string) (int, error) {
+	if len(chunkNames) == 0 {
+		for name, gptSettings := range gptSettingsByName {
+			if gptSettings.FeedbackColumn != "" {
+				chunkNames = append(chunkNames, name)
+			}
+		}
+		sort.Strings(chunkNames)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create %s: %v", path, err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	written := 0
+	for _, name := range chunkNames {
+		keys, err := redisClient.SMembers(samplesKey(name)).Result()
+		if err != nil {
+			return written, fmt.Errorf("unable to read samples of %s: %v", name, err)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, err := redisClient.Get(key).Result()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return written, fmt.Errorf("unable to read %s: %v", key, err)
+			}
+			var sample Sample
+			if err := json.Unmarshal([]byte(value), &sample); err != nil {
+				log.Printf("Error decoding sample %s: %v", key, err)
+				continue
+			}
+
+			answer := sample.Output
+			switch sample.Rating {
+			case feedbackApproved:
+			case feedbackCorrected:
+				answer = sample.Correction
+			default:
+				continue
+			}
+
+			var messages []fineTuneMessage
+			if sample.SystemMessage != "" {
+				messages = append(messages, fineTuneMessage{Role: "system", Content: sample.SystemMessage})
+			}
+			messages = append(messages, sample.Turns...)
+			if sample.UserMessage != "" {
+				messages = append(messages, fineTuneMessage{Role: "user", Content: sample.UserMessage})
+			}
+			messages = append(messages, fineTuneMessage{Role: "assistant", Content: answer})
+			b, err := json.Marshal(map[string]interface{}{"messages": messages})
+			if err != nil {
+				return written, err
+			}
+			if _, err := writer.Write(append(b, '\n')); err != nil {
+				return written, fmt.Errorf("unable to write %s: %v", path, err)
+			}
+			written++
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return written, fmt.Errorf("unable to write %s: %v", path, err)
+	}
+	return written, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// errorStatusPrefix is written in front of the reason when a chunk exhausts its attempts without a fallback value.
+const errorStatusPrefix = "ERROR: "
+
+// OutputGuardrails holds the validators applied to the PromptColTo value of a chunk.
+type OutputGuardrails struct {
+	AllowedValues []string
+	Pattern       *regexp.Regexp
+	MaxLength     int
+	MinValue      *float64
+	MaxValue      *float64
+	Fallback      *string
+	Dropdown      bool
+}
+
+// appliedDropdowns maps a column letter to the allowed values last applied as data validation to it.
+var appliedDropdowns = make(map[string]string)
+
+// parseGuardrailSetting applies a guardrail setting of a chunk to its guardrails.
+// It returns false if the setting is not a guardrail setting, and an error if the value is invalid.
+func parseGuardrailSetting(guardrails *OutputGuardrails, varProp, varValue string) (bool, error) {
+	switch varProp {
+	case "ALLOWED_VALUES":
+		guardrails.AllowedValues = nil
+		for _, allowed := range strings.Split(varValue, ",") {
+			if allowed = strings.TrimSpace(allowed); allowed != "" {
+				guardrails.AllowedValues = append(guardrails.AllowedValues, allowed)
+			}
+		}
+	case "OUTPUT_REGEX":
+		pattern, err := regexp.Compile(varValue)
+		if err != nil {
+			return true, fmt.Errorf("error: OUTPUT_REGEX is not a valid regular expression: %v", err)
+		}
+		guardrails.Pattern = pattern
+	case "MAX_LENGTH":
+		maxLength, err := strconv.Atoi(varValue)
+		if err != nil {
+			return true, fmt.Errorf("error: MAX_LENGTH is not an int. It is a %s", varValue)
+		}
+		guardrails.MaxLength = maxLength
+	case "MIN_VALUE":
+		minValue, err := strconv.ParseFloat(varValue, 64)
+		if err != nil {
+			return true, fmt.Errorf("error: MIN_VALUE is not a float64. It is a %s", varValue)
+		}
+		guardrails.MinValue = &minValue
+	case "MAX_VALUE":
+		maxValue, err := strconv.ParseFloat(varValue, 64)
+		if err != nil {
+			return true, fmt.Errorf("error: MAX_VALUE is not a float64. It is a %s", varValue)
+		}
+		guardrails.MaxValue = &maxValue
+	case "FALLBACK_VALUE":
+		fallback := varValue
+		guardrails.Fallback = &fallback
+	case "OUTPUT_DROPDOWN":
+		dropdown, err := strconv.ParseBool(varValue)
+		if err != nil {
+			return true, fmt.Errorf("error: OUTPUT_DROPDOWN is not a bool. It is a %s", varValue)
+		}
+		guardrails.Dropdown = dropdown
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// validate checks an output value against the guardrails.
+// Allowed values are matched case-insensitively and the canonical spelling is returned.
+// It returns the value to write, or an error describing what was wrong so the model can be re-asked.
+func (g *OutputGuardrails) validate(value interface{}) (interface{}, error) {
+	if !g.enabled() {
+		return value, nil
+	}
+	output := strings.TrimSpace(fmt.Sprint(value))
+
+	if len(g.AllowedValues) > 0 {
+		matched := false
+		for _, allowed := range g.AllowedValues {
+			if strings.EqualFold(output, allowed) {
+				output = allowed
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("the answer %q is not one of the allowed values: %s", output, strings.Join(g.AllowedValues, ", "))
+		}
+	}
+
+	if g.Pattern != nil && !g.Pattern.MatchString(output) {
+		return nil, fmt.Errorf("the answer %q does not match the pattern %s", output, g.Pattern.String())
+	}
+
+	if g.MaxLength > 0 && len([]rune(output)) > g.MaxLength {
+		return nil, fmt.Errorf("the answer is %d characters long, the maximum is %d", len([]rune(output)), g.MaxLength)
+	}
+
+	if g.MinValue != nil || g.MaxValue != nil {
+		number, err := strconv.ParseFloat(output, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the answer %q is not a number", output)
+		}
+		if g.MinValue != nil && number < *g.MinValue {
+			return nil, fmt.Errorf("the answer %v is less than the minimum %v", number, *g.MinValue)
+		}
+		if g.MaxValue != nil && number > *g.MaxValue {
+			return nil, fmt.Errorf("the answer %v is greater than the maximum %v", number, *g.MaxValue)
+		}
+		return number, nil
+	}
+
+	return output, nil
+}
+
+// enabled reports whether any validator is configured.
+func (g *OutputGuardrails) enabled() bool {
+	return len(g.AllowedValues) > 0 || g.Pattern != nil || g.MaxLength > 0 || g.MinValue != nil || g.MaxValue != nil
+}
+
+// applyOutputDropdowns sets a one-of-list data validation on the PromptColTo column of every chunk
+// with OUTPUT_DROPDOWN and allowed values. Validation is only sent again when the allowed values change.
+// It returns an error if the sheet could not be found or updated.
+func applyOutputDropdowns() error {
+	var requests []*sheets.Request
+	sheetID := int64(-1)
+
+	for _, gptSettings := range gptSettingsByName {
+		guardrails := gptSettings.Guardrails
+		if !guardrails.Dropdown || len(guardrails.AllowedValues) == 0 {
+			continue
+		}
+		columnIndex, ok := columnIndexByName[gptSettings.PromptColTo]
+		if !ok {
+			continue
+		}
+		columnLetter := columnLetterByName[gptSettings.PromptColTo]
+		joined := strings.Join(guardrails.AllowedValues, ",")
+		if appliedDropdowns[columnLetter] == joined {
+			continue
+		}
+
+		if sheetID < 0 {
+			id, err := getSheetID(sheetTitle(allSettings["GLOBAL"]["SHEET_NAME"].(string)))
+			if err != nil {
+				return err
+			}
+			sheetID = id
+		}
+
+		conditionValues := make([]*sheets.ConditionValue, len(guardrails.AllowedValues))
+		for i, allowed := range guardrails.AllowedValues {
+			conditionValues[i] = &sheets.ConditionValue{UserEnteredValue: allowed}
+		}
+		requests = append(requests, &sheets.Request{
+			SetDataValidation: &sheets.SetDataValidationRequest{
+				Range: &sheets.GridRange{
+					SheetId:          sheetID,
+					StartRowIndex:    1,
+					StartColumnIndex: int64(columnIndex),
+					EndColumnIndex:   int64(columnIndex + 1),
+				},
+				Rule: &sheets.DataValidationRule{
+					Condition: &sheets.BooleanCondition{
+						Type:   "ONE_OF_LIST",
+						Values: conditionValues,
+					},
+					ShowCustomUi: true,
+				},
+			},
+		})
+		appliedDropdowns[columnLetter] = joined
+	}
+
+	if len(requests) == 0 {
+		return nil
+	}
+
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	_, err := srv.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Do()
+	if err != nil {
+		// Forget what was applied so the next poll tries again
+		appliedDropdowns = make(map[string]string)
+		return fmt.Errorf("failed to apply output dropdowns: %v", err)
+	}
+	log.Printf("Applied %d output dropdown(s)\n", len(requests))
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// historyTabHeader is written to a newly created history tab.
+var historyTabHeader = []interface{}{"Timestamp", "Cell", "Row Key", "Column", "Chunk", "Model", "Old Value", "New Value", "System Prompt", "User Prompt"}
+
+// Columns of the history tab read back by restoreHistory and pruneHistory.
+const (
+	historyTimestampColumn = 0
+	historyCellColumn      = 1
+	historyColumnColumn    = 3
+	historyOldValueColumn  = 6
+	historyNewValueColumn  = 7
+)
+
+// historyPruneInterval is how often old history rows are deleted.
+const historyPruneInterval = time.Hour
+
+var lastHistoryPrune time.Time
+
+// historyTab returns the title of the history tab, or "" if the global HISTORY_TAB setting is not set.
+func historyTab() string {
+	title, _ := allSettings["GLOBAL"]["HISTORY_TAB"].(string)
+	return strings.TrimSpace(title)
+}
+
+// historyText truncates a value so it fits in a history cell.
+func historyText(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	s := fmt.Sprint(value)
+	if runes := []rune(s); len(runes) > maxCellLength {
+		s = string(runes[:maxCellLength])
+	}
+	return s
+}
+
+// recordHistory appends one row per cell written on a row to the history tab: the value the cell held before,
+// the value written, and the prompts and model that produced it.
+// It returns an error if the history tab could not be written.
+func recordHistory(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, cells map[string]interface{}, systemMessage, userMessage, model string) error {
+	title := historyTab()
+	if title == "" || len(cells) == 0 {
+		return nil
+	}
+
+	timestamp := time.Now().In(settingsLocation()).Format(time.RFC3339)
+	key := gptSettings.sourceKey(row, rowIndex)
+	var rows [][]interface{}
+	for columnName, value := range cells {
+		cell := fmt.Sprintf("%s%d", columnLetterByName[columnName], rowIndex+1)
+		rows = append(rows, []interface{}{
+			timestamp, cell, key, columnName, gptSettings.Name, model,
+			historyText(row[columnName]), historyText(value), historyText(systemMessage), historyText(userMessage),
+		})
+	}
+
+	defer lockTab(title)()
+	if _, err := ensureSheet(title, historyTabHeader); err != nil {
+		return err
+	}
+	if _, err := appendToSheetWithRateLimit(title, rows); err != nil {
+		return fmt.Errorf("unable to append to %s: %v", title, err)
+	}
+	return nil
+}
+
+// historyTimeLayouts are the layouts accepted for the time of a restore, in the TIMEZONE setting's location.
+var historyTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseHistoryTime parses the time of a restore.
+// It returns an error if the value matches none of the accepted layouts.
+func parseHistoryTime(value string) (time.Time, error) {
+	for _, layout := range historyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, settingsLocation()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time such as 2006-01-02 15:04", value)
+}
+
+// parseRestoreCommand parses the arguments of a restore, such as "COLUMN Summary TO 2026-10-01 12:00",
+// "ROW 12 TO 2026-10-01" or "COLUMN Summary ROW 12 TO 2026-10-01T12:00:00Z". Column names may contain spaces.
+// It returns the column name, the sheet row number (0 for every row) and the time to roll back to.
+func parseRestoreCommand(args []string) (string, int, time.Time, error) {
+	var column []string
+	var rowNumber int
+	var at []string
+	var current *[]string
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COLUMN":
+			current = &column
+			continue
+		case "ROW":
+			if i+1 >= len(args) {
+				return "", 0, time.Time{}, fmt.Errorf("ROW needs a row number")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 2 {
+				return "", 0, time.Time{}, fmt.Errorf("%q is not a row number", args[i+1])
+			}
+			rowNumber = n
+			current = nil
+			i++
+			continue
+		case "TO":
+			current = &at
+			continue
+		}
+		if current == nil {
+			return "", 0, time.Time{}, fmt.Errorf("unexpected %q", args[i])
+		}
+		*current = append(*current, args[i])
+	}
+
+	if len(column) == 0 && rowNumber == 0 {
+		return "", 0, time.Time{}, fmt.Errorf("expected COLUMN <name> and/or ROW <number>")
+	}
+	if len(at) == 0 {
+		return "", 0, time.Time{}, fmt.Errorf("expected TO <time>")
+	}
+	t, err := parseHistoryTime(strings.Join(at, " "))
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	return strings.Join(column, " "), rowNumber, t, nil
+}
+
+// restoreHistory rolls the cells of a column, a row, or a single cell back to the values they held at a time,
+// as recorded in the history tab. Each cell gets the value written by its last entry at or before that time,
+// or the value it held before its first entry after it. Cells without history are left alone.
+// The restored values are written as is and recorded in the history tab. They count as manual edits,
+// so the default ON_MANUAL_EDIT policy keeps them from being regenerated over.
+// It returns the number of cells restored, or an error if the history tab could not be read or the sheet written.
+func restoreHistory(column string, rowNumber int, at time.Time) (int, error) {
+	title := historyTab()
+	if title == "" {
+		return 0, fmt.Errorf("HISTORY_TAB is not set")
+	}
+
+	resp, err := readFromSheetWithRateLimit(spreadsheetID, fmt.Sprintf("'%s'!A:J", title))
+	if err != nil {
+		return 0, fmt.Errorf("unable to read %s: %v", title, err)
+	}
+
+	type restoredCell struct {
+		Column string
+		Value  string
+		Before bool
+	}
+	targets := make(map[string]*restoredCell)
+	var order []string
+	for i, entry := range resp.Values {
+		if i == 0 || len(entry) <= historyNewValueColumn {
+			continue
+		}
+		cell := fmt.Sprint(entry[historyCellColumn])
+		columnName := fmt.Sprint(entry[historyColumnColumn])
+		if column != "" && columnName != column {
+			continue
+		}
+		if rowNumber != 0 {
+			if _, _, n, err := parseA1Cell(cell); err != nil || n != rowNumber {
+				continue
+			}
+		}
+		timestamp, err := time.Parse(time.RFC3339, fmt.Sprint(entry[historyTimestampColumn]))
+		if err != nil {
+			continue
+		}
+
+		target, ok := targets[cell]
+		if !ok {
+			target = &restoredCell{Column: columnName}
+			targets[cell] = target
+			order = append(order, cell)
+		}
+		if !timestamp.After(at) {
+			// Entries are in time order, so the last one at or before the time wins
+			target.Value = fmt.Sprint(entry[historyNewValueColumn])
+			target.Before = true
+		} else if !target.Before && !ok {
+			target.Value = fmt.Sprint(entry[historyOldValueColumn])
+		}
+	}
+	if len(order) == 0 {
+		return 0, nil
+	}
+
+	sheetName := sheetTitle(allSettings["GLOBAL"]["SHEET_NAME"].(string))
+	var data []*sheets.ValueRange
+	var rows [][]interface{}
+	timestamp := time.Now().In(settingsLocation()).Format(time.RFC3339)
+	for _, cell := range order {
+		target := targets[cell]
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("'%s'!%s", sheetName, cell),
+			Values: [][]interface{}{{target.Value}},
+		})
+		rows = append(rows, []interface{}{timestamp, cell, "", target.Column, "restore", "", "", target.Value, "", fmt.Sprintf("Restored to %s", at.Format(time.RFC3339))})
+	}
+
+	if _, err := batchWriteToSheetWithRateLimit(spreadsheetID, data, "RAW"); err != nil {
+		return 0, fmt.Errorf("unable to restore: %v", err)
+	}
+
+	defer lockTab(title)()
+	if _, err := appendToSheetWithRateLimit(title, rows); err != nil {
+		log.Printf("Error appending to %s: %v", title, err)
+	}
+	return len(order), nil
+}
+
+// pruneHistory deletes history rows older than HISTORY_RETENTION_DAYS and the oldest rows beyond HISTORY_MAX_ROWS.
+// It runs at most once per historyPruneInterval.
+// It returns an error if the history tab could not be read or updated.
+func pruneHistory() error {
+	title := historyTab()
+	if title == "" || time.Since(lastHistoryPrune) < historyPruneInterval {
+		return nil
+	}
+	retentionDays, _ := allSettings["GLOBAL"]["HISTORY_RETENTION_DAYS"].(int)
+	maxRows, _ := allSettings["GLOBAL"]["HISTORY_MAX_ROWS"].(int)
+	if retentionDays <= 0 && maxRows <= 0 {
+		return nil
+	}
+	lastHistoryPrune = time.Now()
+
+	defer lockTab(title)()
+
+	resp, err := readFromSheetWithRateLimit(spreadsheetID, fmt.Sprintf("'%s'!A:A", title))
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", title, err)
+	}
+	entries := len(resp.Values) - 1
+
+	expired := 0
+	if retentionDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -retentionDays)
+		for i := 1; i < len(resp.Values); i++ {
+			if len(resp.Values[i]) == 0 {
+				break
+			}
+			timestamp, err := time.Parse(time.RFC3339, fmt.Sprint(resp.Values[i][0]))
+			if err != nil || !timestamp.Before(cutoff) {
+				break
+			}
+			expired = i
+		}
+	}
+	if maxRows > 0 && entries-expired > maxRows {
+		expired = entries - maxRows
+	}
+	if expired <= 0 {
+		return nil
+	}
+
+	sheetID, err := getSheetID(title)
+	if err != nil {
+		return err
+	}
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{{
+			DeleteDimension: &sheets.DeleteDimensionRequest{
+				Range: &sheets.DimensionRange{
+					SheetId:    sheetID,
+					Dimension:  "ROWS",
+					StartIndex: 1,
+					EndIndex:   int64(expired + 1),
+				},
+			},
+		}},
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("unable to prune %s: %v", title, err)
+	}
+	log.Printf("Pruned %d history row(s) from %s\n", expired, title)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLookupRefreshFrequency is how often, in seconds, referenced tabs are fetched again
+// when LOOKUP_REFRESH_FREQUENCY is not set.
+const defaultLookupRefreshFrequency = 300.0
+
+// lookupCache holds the values of the tabs and ranges referenced by LOOKUP and RANGE tokens,
+// keyed by the range they were fetched with.
+var lookupCache = make(map[string][][]interface{})
+var lookupHashes = make(map[string][32]byte)
+var lookupCacheMutex = &sync.RWMutex{}
+var lastLookupRefresh time.Time
+
+// changedLookupRanges holds the lookup ranges whose content changed in the latest refresh.
+// Chunks with LOOKUP_TRIGGER re-run when a range they reference is in it.
+var changedLookupRanges = make(map[string]bool)
+
+// lookupRanges returns the ranges referenced by a template's LOOKUP and RANGE tokens.
+// A LOOKUP token references its whole tab, a RANGE token references the given A1 range.
+func lookupRanges(message string) []string {
+	var ranges []string
+	for _, prefix := range []string{"{LOOKUP:", "{RANGE:"} {
+		rest := message
+		for {
+			i := strings.Index(rest, prefix)
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len(prefix):]
+			end := strings.IndexAny(rest, "}=")
+			if end < 0 {
+				break
+			}
+			reference := rest[:end]
+			if prefix == "{LOOKUP:" {
+				reference = sheetTitle(reference)
+			}
+			ranges = append(ranges, reference)
+		}
+	}
+	return ranges
+}
+
+// referencedLookupRanges returns the lookup ranges referenced by a chunk's templates, including its steps and
+// MESSAGES turns, its EXAMPLES_TAB and the tabs its lookup_tab tool can read.
+func (c ChunkSettings) referencedLookupRanges() []string {
+	ranges := append(lookupRanges(c.SystemMessage), lookupRanges(c.UserMessage)...)
+	for _, step := range c.steps() {
+		ranges = append(ranges, lookupRanges(step.SystemMessage)...)
+		ranges = append(ranges, lookupRanges(step.UserMessage)...)
+	}
+	for _, turn := range c.Messages {
+		ranges = append(ranges, lookupRanges(turn.Template)...)
+	}
+	if c.Examples.Tab != "" {
+		ranges = append(ranges, c.Examples.Tab)
+	}
+	if c.Tools.enabled(toolLookupTab) {
+		ranges = append(ranges, c.Tools.Tabs...)
+	}
+	return ranges
+}
+
+// refreshLookupTabs fetches every range referenced by a chunk in one batchGet once LOOKUP_REFRESH_FREQUENCY
+// seconds have passed since the last refresh, and records which ranges changed.
+// It returns an error if the ranges could not be read.
+func refreshLookupTabs() error {
+	frequency := defaultLookupRefreshFrequency
+	if s, ok := allSettings["GLOBAL"]["LOOKUP_REFRESH_FREQUENCY"].(float64); ok {
+		frequency = s
+	}
+
+	seen := make(map[string]bool)
+	var ranges []string
+	for _, gptSettings := range gptSettingsByName {
+		for _, range_ := range gptSettings.referencedLookupRanges() {
+			if !seen[range_] {
+				seen[range_] = true
+				ranges = append(ranges, range_)
+			}
+		}
+	}
+
+	lookupCacheMutex.RLock()
+	missing := false
+	for _, range_ := range ranges {
+		if _, ok := lookupCache[range_]; !ok {
+			missing = true
+		}
+	}
+	lookupCacheMutex.RUnlock()
+
+	changedLookupRanges = make(map[string]bool)
+	if len(ranges) == 0 || (!missing && time.Since(lastLookupRefresh).Seconds() < frequency) {
+		return nil
+	}
+
+	quoted := make([]string, len(ranges))
+	for i, range_ := range ranges {
+		quoted[i] = quoteRange(range_)
+	}
+
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	resp, err := srv.Spreadsheets.Values.BatchGet(spreadsheetID).Ranges(quoted...).Do()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve lookup tabs: %v", err)
+	}
+	lastLookupRefresh = time.Now()
+
+	lookupCacheMutex.Lock()
+	defer lookupCacheMutex.Unlock()
+	for i, valueRange := range resp.ValueRanges {
+		range_ := ranges[i]
+		hash := sha256.Sum256([]byte(fmt.Sprint(valueRange.Values)))
+		if previous, ok := lookupHashes[range_]; ok && previous != hash {
+			log.Printf("Lookup range %s has changed\n", range_)
+			changedLookupRanges[range_] = true
+		}
+		lookupHashes[range_] = hash
+		lookupCache[range_] = valueRange.Values
+	}
+
+	return nil
+}
+
+// quoteRange quotes the sheet title of an A1 range so titles with spaces can be fetched.
+func quoteRange(range_ string) string {
+	title := sheetTitle(range_)
+	if i := strings.Index(range_, "!"); i >= 0 {
+		return fmt.Sprintf("'%s'%s", title, range_[i:])
+	}
+	return fmt.Sprintf("'%s'", title)
+}
+
+// lookupTriggered reports whether a range referenced by the chunk changed in the latest refresh
+// and the chunk re-runs on such changes.
+func (c ChunkSettings) lookupTriggered() bool {
+	if !c.LookupTrigger {
+		return false
+	}
+	for _, range_ := range c.referencedLookupRanges() {
+		if changedLookupRanges[range_] {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateLookupToken evaluates "Catalog!SKU=value:Description", returning the Description of the first row
+// of the Catalog tab whose SKU matches the value.
+// It returns an error if the token is malformed or the tab has not been fetched.
+func evaluateLookupToken(body string) (string, error) {
+	reference, returnColumn, ok := cutLast(body, ":")
+	if !ok {
+		return "", fmt.Errorf("expected {LOOKUP:<tab>!<column>=<value>:<column>}")
+	}
+	reference, expected, ok := strings.Cut(reference, "=")
+	if !ok {
+		return "", fmt.Errorf("expected {LOOKUP:<tab>!<column>=<value>:<column>}")
+	}
+	title := sheetTitle(reference)
+	matchColumn := strings.TrimSpace(reference[strings.Index(reference, "!")+1:])
+
+	lookupCacheMutex.RLock()
+	rows, ok := lookupCache[title]
+	lookupCacheMutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("tab %q has not been fetched", title)
+	}
+	if len(rows) == 0 {
+		return "", nil
+	}
+
+	matchIndex, returnIndex := -1, -1
+	for i, header := range rows[0] {
+		switch strings.TrimSpace(fmt.Sprint(header)) {
+		case matchColumn:
+			matchIndex = i
+		case strings.TrimSpace(returnColumn):
+			returnIndex = i
+		}
+	}
+	if matchIndex < 0 || returnIndex < 0 {
+		return "", fmt.Errorf("tab %q has no column %q or %q", title, matchColumn, returnColumn)
+	}
+
+	expected = strings.TrimSpace(expected)
+	for _, row := range rows[1:] {
+		if matchIndex < len(row) && strings.EqualFold(strings.TrimSpace(fmt.Sprint(row[matchIndex])), expected) {
+			if returnIndex < len(row) {
+				return fmt.Sprint(row[returnIndex]), nil
+			}
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+// evaluateRangeToken renders a cached range as one line per row with cells separated by " | ".
+// It returns an error if the range has not been fetched.
+func evaluateRangeToken(body string) (string, error) {
+	range_ := strings.TrimSpace(body)
+
+	lookupCacheMutex.RLock()
+	rows, ok := lookupCache[range_]
+	lookupCacheMutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("range %q has not been fetched", range_)
+	}
+
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = fmt.Sprint(cell)
+		}
+		lines = append(lines, strings.Join(cells, " | "))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -26,13 +26,66 @@ type ColumnVariable struct {
 }
 
 type ChunkSettings struct {
-	Name          string
-	TriggerColumn []string
-	SystemMessage string
-	UserMessage   string
-	Temperature   float32
-	MaxTokens     int
-	PromptColTo   string
+	Name            string
+	TriggerColumn   []string
+	SystemMessage   string
+	UserMessage     string
+	Temperature     float32
+	MaxTokens       int
+	PromptColTo     string
+	OutputSchema    *OutputSchema
+	OutputRetries   int
+	Guardrails      OutputGuardrails
+	PostProcess     []PostProcessor
+	Safety          OutputSafety
+	OnManualEdit    string
+	ShadowColumn    string
+	Placeholder     string
+	LookupTrigger   bool
+	Mode            string
+	GroupBy         string
+	OutputTab       string
+	KeyColumn       string
+	MaxItems        int
+	OutputRangeMode string
+	TableAnchor     string
+	Filter          RowFilter
+	RerunColumn     string
+	Disabled        bool
+	ActiveHours     *ActiveHours
+	OnPromptChange  string
+	Model           string
+	Variant         PromptVariant
+	Eval            EvalSettings
+	FeedbackColumn  string
+	Examples        ExampleSettings
+	Messages        []ChatTurn
+	Steps           []string
+	StepDefinitions map[string]ChunkStep
+	StepsOutput     string
+	Tools           ToolSettings
+	Route           *ChunkRoute
+}
+
+// destinationColumns returns the columns a chunk writes to.
+// Chunks with an output schema write one column per schema property, other chunks write PromptColTo.
+func (c ChunkSettings) destinationColumns() []string {
+	if c.OutputSchema != nil {
+		return c.OutputSchema.Columns
+	}
+	return []string{c.PromptColTo}
+}
+
+// hasDestination reports whether the chunk has somewhere to write its output:
+// OUTPUT_TAB for EXPAND chunks, TABLE_ANCHOR or OUTPUT_TAB for table chunks and PromptColTo otherwise.
+func (c ChunkSettings) hasDestination() bool {
+	switch {
+	case c.Mode == chunkModeExpand:
+		return c.OutputTab != ""
+	case c.isTable():
+		return c.OutputTab != "" || c.TableAnchor != ""
+	}
+	return c.PromptColTo != ""
 }
 
 var allSettings map[string]map[string]interface{}
@@ -62,7 +115,6 @@ var su *stats.StatsUpdater // Define global variable for stats updater
 
 // setupEnvironment loads environment variables, creates the Google Sheets and Redis services,
 // and initializes a map of mutexes for each cell in the Google Sheets.
-// It also creates a stats updater, creates the "Stats" sheet, and writes the stat names.
 // It handles any errors that occur during these operations by calling the handleError function,
 // which increments the "Errors" counter and updates the "Errors" and "Last Error" stats.
 // It returns an error if an error occurred while creating the mutexes.
@@ -99,13 +151,6 @@ func setupEnvironment() error {
 	}
 	srv = tmpSrv
 
-	// Create new StatsUpdater
-	su, err = stats.NewStatsUpdater(spreadsheetID, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), []string{"Total Rows Processed", "Errors", "Successful Completions", "Last Error"})
-	if err != nil {
-		handleError(err) // Call handleError function instead of returning the error directly
-		return nil
-	}
-
 	// Get Redis configuration from environment variables
 	redisAddr := os.Getenv("REDIS_ADDR")
 	redisPassword := os.Getenv("REDIS_PASSWORD")
@@ -152,6 +197,16 @@ func setupEnvironment() error {
 	return nil
 }
 
+// setupStats creates the stats updater, which creates the "Stats" sheet and writes the stat names.
+// Only the engine calls it: the stats sheet is rewritten, so CLI subcommands leave it to the running engine.
+func setupStats() {
+	var err error
+	su, err = stats.NewStatsUpdater(spreadsheetID, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), []string{"Total Rows Processed", "Errors", "Successful Completions", "Last Error", "Sanitized Writes", "Split Writes", "Prompt Change Progress", "Variant A", "Variant B"})
+	if err != nil {
+		handleError(err) // Call handleError function instead of returning the error directly
+	}
+}
+
 // handleError function increments the "Errors" counter and updates the "Errors" and "Last Error" stats.
 func handleError(err error) {
 	// Increment the "Errors" counter
@@ -161,7 +216,7 @@ func handleError(err error) {
 	lastError = err.Error()
 
 	// If STATS is true, update the "Errors" and "Last Error" stats
-	if statsEnabled, ok := allSettings["GLOBAL"]["STATS"].(bool); ok && statsEnabled {
+	if statsEnabled, ok := allSettings["GLOBAL"]["STATS"].(bool); ok && statsEnabled && su != nil {
 		// Assume su is an instance of StatsUpdater from the stats.go file
 		errUpdate := su.UpdateStats("Errors", errorCount)
 		if errUpdate != nil {
@@ -175,6 +230,17 @@ func handleError(err error) {
 	}
 }
 
+// recordStat updates a stat in the "Stats" sheet if the STATS setting is true, logging any error.
+// Stats are not recorded by CLI subcommands, which have no stats updater.
+func recordStat(statName string, value interface{}) {
+	if statsEnabled, ok := allSettings["GLOBAL"]["STATS"].(bool); ok && statsEnabled && su != nil {
+		err := su.UpdateStats(statName, value)
+		if err != nil {
+			log.Printf("Error updating stats: %v", err)
+		}
+	}
+}
+
 // readSettings reads settings from the Google Sheet and updates the global settings variables.
 // It returns an error if an error occurred while reading the settings.
 func readSettings() error {
@@ -188,8 +254,10 @@ func readSettings() error {
 
 	gptSettingsByName = make(map[string]ChunkSettings)
 	_ = make(map[int]ColumnVariable)
+	resetSheetIDs()
 
-	for _, row := range resp.Values {
+	commandRow = 0
+	for i, row := range resp.Values {
 		if len(row) < 2 {
 			continue
 		}
@@ -225,6 +293,39 @@ func readSettings() error {
 				} else {
 					log.Printf("Error: SHEETS_RATE_LIMIT is not an int. It is a %s", value)
 				}
+			case "LOOKUP_REFRESH_FREQUENCY":
+				if s, err := strconv.ParseFloat(value.(string), 64); err == nil {
+					allSettings["GLOBAL"]["LOOKUP_REFRESH_FREQUENCY"] = s
+				} else {
+					log.Printf("Error: LOOKUP_REFRESH_FREQUENCY is not a float64. It is a %s", value)
+				}
+			case "COMMAND":
+				allSettings["GLOBAL"]["COMMAND"] = value
+				commandRow = i + 1
+			case "PAUSED":
+				if s, err := strconv.ParseBool(value.(string)); err == nil {
+					allSettings["GLOBAL"]["PAUSED"] = s
+				} else {
+					log.Printf("Error: PAUSED is not a bool. It is a %s", value)
+				}
+			case "ACTIVE_HOURS":
+				if s, err := parseActiveHours(value.(string)); err == nil {
+					allSettings["GLOBAL"]["ACTIVE_HOURS"] = s
+				} else {
+					log.Printf("Error: ACTIVE_HOURS is invalid: %v", err)
+				}
+			case "HISTORY_RETENTION_DAYS", "HISTORY_MAX_ROWS":
+				if s, err := strconv.Atoi(value.(string)); err == nil {
+					allSettings["GLOBAL"][key] = s
+				} else {
+					log.Printf("Error: %s is not an int. It is a %s", key, value)
+				}
+			case "PROVENANCE_NOTES":
+				if s, err := strconv.ParseBool(value.(string)); err == nil {
+					allSettings["GLOBAL"]["PROVENANCE_NOTES"] = s
+				} else {
+					log.Printf("Error: PROVENANCE_NOTES is not a bool. It is a %s", value)
+				}
 			case "STATS":
 				if s, err := strconv.ParseBool(value.(string)); err == nil {
 					allSettings["GLOBAL"]["STATS"] = s
@@ -246,7 +347,7 @@ func readSettings() error {
 
 			currentSettings, exists := gptSettingsByName[currentSettingsName]
 			if !exists {
-				currentSettings = ChunkSettings{Name: currentSettingsName}
+				currentSettings = ChunkSettings{Name: currentSettingsName, OutputRetries: defaultOutputRetries}
 			}
 
 			switch varProp {
@@ -274,59 +375,232 @@ func readSettings() error {
 				}
 			case "PROMPT_COL_TO":
 				currentSettings.PromptColTo = varValue
+			case "OUTPUT_SCHEMA":
+				schema, err := parseOutputSchema(varValue)
+				if err != nil {
+					return fmt.Errorf("error: OUTPUT_SCHEMA of %s is invalid: %v", currentSettingsName, err)
+				}
+				currentSettings.OutputSchema = schema
+				if currentSettings.PromptColTo == "" {
+					currentSettings.PromptColTo = schema.Columns[0]
+				}
+			case "OUTPUT_RETRIES":
+				if retries, err := strconv.Atoi(varValue); err == nil {
+					currentSettings.OutputRetries = retries
+				} else {
+					return fmt.Errorf("error: OUTPUT_RETRIES is not an int. It is a %s", varValue)
+				}
+			case "POSTPROCESS":
+				processors, err := parsePostProcessors(varValue)
+				if err != nil {
+					return fmt.Errorf("error: POSTPROCESS of %s is invalid: %v", currentSettingsName, err)
+				}
+				currentSettings.PostProcess = processors
+			case "OUTPUT_SANITIZE":
+				mode, err := parseSanitizeMode(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.Safety.Mode = mode
+			case "OVERFLOW_COLS":
+				splitValues := strings.Split(varValue, ",")
+				for i, val := range splitValues {
+					splitValues[i] = strings.TrimSpace(val)
+				}
+				currentSettings.Safety.OverflowColumns = splitValues
+			case "OVERFLOW_TAB":
+				currentSettings.Safety.OverflowTab = strings.TrimSpace(varValue)
+			case "ON_MANUAL_EDIT":
+				policy, err := parseManualEditPolicy(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.OnManualEdit = policy
+			case "SHADOW_COL":
+				currentSettings.ShadowColumn = strings.TrimSpace(varValue)
+			case "PLACEHOLDER":
+				currentSettings.Placeholder = varValue
+			case "MODE":
+				currentSettings.Mode = strings.ToUpper(strings.TrimSpace(varValue))
+			case "GROUP_BY":
+				currentSettings.GroupBy = strings.TrimSpace(varValue)
+			case "OUTPUT_TAB":
+				currentSettings.OutputTab = strings.TrimSpace(varValue)
+			case "OUTPUT_RANGE_MODE":
+				currentSettings.OutputRangeMode = strings.ToUpper(strings.TrimSpace(varValue))
+			case "TABLE_ANCHOR":
+				currentSettings.TableAnchor = strings.TrimSpace(varValue)
+			case "WHERE":
+				where, err := parseWhere(varValue)
+				if err != nil {
+					return fmt.Errorf("error: WHERE of %s is invalid: %v", currentSettingsName, err)
+				}
+				currentSettings.Filter.Where = where
+			case "ROW_RANGE":
+				firstRow, lastRow, err := parseRowRange(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.Filter.FirstRow = firstRow
+				currentSettings.Filter.LastRow = lastRow
+			case "SAMPLE_PERCENT":
+				if percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(varValue), "%"), 64); err != nil {
+					return fmt.Errorf("error: SAMPLE_PERCENT is not a float64. It is a %s", varValue)
+				} else if percent <= 0 || percent > 100 {
+					return fmt.Errorf("error: SAMPLE_PERCENT must be more than 0 and at most 100. It is %s", varValue)
+				} else {
+					currentSettings.Filter.SamplePercent = percent
+				}
+			case "RERUN_COL":
+				currentSettings.RerunColumn = strings.TrimSpace(varValue)
+			case "ON_PROMPT_CHANGE":
+				policy, err := parsePromptChangePolicy(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.OnPromptChange = policy
+			case "ENABLED":
+				if enabled, err := strconv.ParseBool(strings.TrimSpace(varValue)); err == nil {
+					currentSettings.Disabled = !enabled
+				} else {
+					return fmt.Errorf("error: ENABLED is not a bool. It is a %s", varValue)
+				}
+			case "ACTIVE_HOURS":
+				activeHours, err := parseActiveHours(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.ActiveHours = activeHours
+			case "KEY_COL":
+				currentSettings.KeyColumn = strings.TrimSpace(varValue)
+			case "MAX_ITEMS":
+				if maxItems, err := strconv.Atoi(varValue); err == nil {
+					currentSettings.MaxItems = maxItems
+				} else {
+					return fmt.Errorf("error: MAX_ITEMS is not an int. It is a %s", varValue)
+				}
+			case "LOOKUP_TRIGGER":
+				if lookupTrigger, err := strconv.ParseBool(varValue); err == nil {
+					currentSettings.LookupTrigger = lookupTrigger
+				} else {
+					return fmt.Errorf("error: LOOKUP_TRIGGER is not a bool. It is a %s", varValue)
+				}
+			case "MODEL":
+				currentSettings.Model = strings.TrimSpace(varValue)
+			case "MESSAGES":
+				turns, err := parseMessages(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.Messages = turns
+			case "ROUTE":
+				route, err := parseRoute(varValue)
+				if err != nil {
+					return err
+				}
+				currentSettings.Route = route
+			case "FEEDBACK_COL":
+				currentSettings.FeedbackColumn = strings.TrimSpace(varValue)
+			default:
+				if ok, err := parseToolSetting(&currentSettings.Tools, varProp, varValue); ok || err != nil {
+					if err != nil {
+						return err
+					}
+					break
+				}
+				if ok, err := parseStepSetting(&currentSettings, varProp, varValue); ok || err != nil {
+					if err != nil {
+						return err
+					}
+					break
+				}
+				if ok, err := parseVariantSetting(&currentSettings.Variant, varProp, varValue); ok || err != nil {
+					if err != nil {
+						return err
+					}
+					break
+				}
+				if ok, err := parseEvalSetting(&currentSettings.Eval, varProp, varValue); ok || err != nil {
+					if err != nil {
+						return err
+					}
+					break
+				}
+				if ok, err := parseExampleSetting(&currentSettings.Examples, varProp, varValue); ok || err != nil {
+					if err != nil {
+						return err
+					}
+					break
+				}
+				if _, err := parseGuardrailSetting(&currentSettings.Guardrails, varProp, varValue); err != nil {
+					return err
+				}
 			}
 
 			gptSettingsByName[currentSettingsName] = currentSettings
 		}
 	}
+	resolveRoutes()
+	validateDestinations()
 	return nil
 }
 
 // detectChanges compares the current state with the previous state and logs any changes.
 // It updates the previous state in Redis and processes any detected changes.
+// The rows are kept as the snapshot aggregate tokens are evaluated against.
+// Aggregate chunks are run once per group of rows after the row-level chunks have been dispatched.
+// Feedback given in a chunk's FEEDBACK_COL is stored with the chunk's sample for the row.
+// Rows whose rerun was requested by a checkbox or a RERUN command run regardless of the cache and filters,
+// as long as their trigger columns have values.
+// Rows generated with an earlier definition of a chunk are rerun according to its ON_PROMPT_CHANGE policy,
+// and the share of up-to-date rows is written to the Stats sheet.
+// Nothing is dispatched while the engine is paused. Triggers of chunks that are disabled or outside their active
+// hours are queued in Redis and dispatched once the chunk is active again.
 // It returns an error if an error occurred.
 func detectChanges(currentRows [][]interface{}, shouldCheckForNewColumns bool) error {
-	columnNameByIndex = make(map[int]string)
-	columnIndexByName = make(map[string]int)
-	columnLetterByName = make(map[string]string)
+	sheetRows = currentRows
+	indexColumns(currentRows[0])
+	if shouldCheckForNewColumns || len(invalidDestinations) > 0 {
+		validateDestinations()
+	}
 
-	for i := range currentRows[0] {
-		columnName, ok := currentRows[0][i].(string)
-		if !ok {
-			log.Printf("Error: columnName is not a string. It is a %T", currentRows[0][i])
-			continue
-		}
-		columnNameByIndex[i] = columnName
-		columnIndexByName[columnName] = i
-		columnLetterByName[columnName] = getExcelColumnName(i + 1)
+	if err := applyOutputDropdowns(); err != nil {
+		log.Printf("Error applying output dropdowns: %v", err)
+	}
+
+	// Leave changes uncached while paused so they are picked up after RESUME
+	if globalPaused() {
+		log.Printf("Engine is paused, not checking for changes\n")
+		return nil
 	}
+	defer func() { pendingReruns = make(map[string][]rerunRange) }()
+
+	now := time.Now()
+	queuedTriggers := loadQueuedTriggers(now)
+	progress := make(promptChangeProgress)
+	defer progress.record()
 
 	for rowIndex := range currentRows {
 		if rowIndex == 0 {
 			continue
 		}
 
-		currentRow = make(map[string]interface{})
-
-		for columnIndex := range currentRows[rowIndex] {
-			currentRow["RowIndex"] = rowIndex
-			currentRow[columnNameByIndex[columnIndex]] = currentRows[rowIndex][columnIndex]
-		}
-
-		for _, columnName := range columnNameByIndex {
-			if _, ok := currentRow[columnName]; !ok {
-				currentRow[columnName] = ""
-			}
-		}
+		currentRow = rowMap(currentRows, rowIndex)
 
 		for _, gptSettings := range gptSettingsByName {
-			if len(gptSettings.UserMessage) == 0 || len(gptSettings.SystemMessage) == 0 {
+			if gptSettings.Mode == chunkModeAggregate {
+				continue
+			}
+			if gptSettings.FeedbackColumn != "" {
+				collectFeedback(currentRow, rowIndex, gptSettings)
+			}
+			if !gptSettings.hasPrompts() {
 				continue
 			}
 			if gptSettings.Temperature == 0 || gptSettings.MaxTokens == 0 {
 				continue
 			}
-			if len(gptSettings.PromptColTo) == 0 {
+			if !gptSettings.hasDestination() || invalidDestinations[gptSettings.Name] {
 				continue
 			}
 			if len(gptSettings.TriggerColumn) == 0 {
@@ -348,7 +622,7 @@ func detectChanges(currentRows [][]interface{}, shouldCheckForNewColumns bool) e
 				}
 			}
 
-			if shouldCheckForNewColumns {
+			if shouldCheckForNewColumns && len(gptSettings.PromptColTo) > 0 {
 				newColumnValue := currentRow[gptSettings.PromptColTo]
 				if newColumnValue == nil || newColumnValue == "" {
 					if rowHadTriggerColumnValues {
@@ -357,9 +631,64 @@ func detectChanges(currentRows [][]interface{}, shouldCheckForNewColumns bool) e
 				}
 			}
 
-			if rowMissingNewColumns || (rowHadTriggerColumnValues && rowHadChangedTriggerColumnsCount == len(gptSettings.TriggerColumn)) {
-				if rowMissingNewColumns {
+			lookupTriggered := rowHadTriggerColumnValues && gptSettings.lookupTriggered()
+			rerunRequested, rerunSource := gptSettings.rerunRequested(currentRow)
+			if rerunRequested && !rowHadTriggerColumnValues {
+				log.Printf("Row #%d rerun of gptSettings '%s' requested by %s skipped, a trigger column is empty\n", currentRow["RowIndex"], gptSettings.Name, rerunSource)
+				untickRerun(currentRow, gptSettings)
+				rerunRequested = false
+			}
+			triggered := lookupTriggered || (rowHadTriggerColumnValues && rowHadChangedTriggerColumnsCount == len(gptSettings.TriggerColumn))
+
+			if !gptSettings.isActive(now) {
+				if triggered || rerunRequested {
+					log.Printf("Row #%d trigger of gptSettings '%s' queued until it is active\n", currentRow["RowIndex"], gptSettings.Name)
+					queueTrigger(gptSettings.Name, rowIndex)
+				}
+				continue
+			}
+			queued := queuedTriggers[gptSettings.Name][rowIndex]
+
+			promptChanged := false
+			if gptSettings.OnPromptChange == promptChangeRerunAll || gptSettings.OnPromptChange == promptChangeNextTrigger {
+				generated, stale := gptSettings.definitionState(rowIndex)
+				if generated {
+					progress.add(gptSettings.Name, stale)
+				}
+				if gptSettings.OnPromptChange == promptChangeRerunAll {
+					promptChanged = stale && rowHadTriggerColumnValues
+				} else {
+					promptChanged = stale && rowHadTriggerColumnValues && rowHadChangedTriggerColumnsCount > 0
+				}
+			}
+
+			if rerunRequested || queued || rowMissingNewColumns || triggered || promptChanged {
+				if promptChanged && !rerunRequested && !queued && !rowMissingNewColumns && !triggered {
+					if !gptSettings.Filter.allows(gptSettings.Name, currentRow) || !startPromptChangeRerun(gptSettings.Name, rowIndex) {
+						continue
+					}
+					log.Printf("Row #%d definition change of gptSettings '%s' triggered a rerun\n", currentRow["RowIndex"], gptSettings.Name)
+					if err := runGptSettingsOnRowWithSemaphore(currentRow, gptSettings); err != nil {
+						log.Printf("Error running GPT settings on row: %v", err)
+					}
+					continue
+				}
+				if queued {
+					dequeueTrigger(gptSettings.Name, rowIndex)
+				}
+				if !rerunRequested && !gptSettings.Filter.allows(gptSettings.Name, currentRow) {
+					continue
+				}
+
+				if rerunRequested {
+					log.Printf("Row #%d rerun of gptSettings '%s' requested by %s\n", currentRow["RowIndex"], gptSettings.Name, rerunSource)
+					untickRerun(currentRow, gptSettings)
+				} else if queued && !triggered {
+					log.Printf("Row #%d queued trigger of gptSettings '%s' dispatched\n", currentRow["RowIndex"], gptSettings.Name)
+				} else if rowMissingNewColumns {
 					log.Printf("Row #%d is missing value in new column '%s'\n", currentRow["RowIndex"], gptSettings.PromptColTo)
+				} else if lookupTriggered && rowHadChangedTriggerColumnsCount != len(gptSettings.TriggerColumn) {
+					log.Printf("Row #%d lookup tab change triggered gptSettings '%s'\n", currentRow["RowIndex"], gptSettings.Name)
 				} else {
 					log.Printf("Row #%d change triggered gptSettings '%s'\n", currentRow["RowIndex"], gptSettings.Name)
 				}
@@ -372,9 +701,47 @@ func detectChanges(currentRows [][]interface{}, shouldCheckForNewColumns bool) e
 			}
 		}
 	}
+
+	runAggregateChunks(currentRows)
 	return nil
 }
 
+// indexColumns builds the column maps from the header row of the watched sheet.
+func indexColumns(header []interface{}) {
+	columnNameByIndex = make(map[int]string)
+	columnIndexByName = make(map[string]int)
+	columnLetterByName = make(map[string]string)
+
+	for i := range header {
+		columnName, ok := header[i].(string)
+		if !ok {
+			log.Printf("Error: columnName is not a string. It is a %T", header[i])
+			continue
+		}
+		columnNameByIndex[i] = columnName
+		columnIndexByName[columnName] = i
+		columnLetterByName[columnName] = getExcelColumnName(i + 1)
+	}
+}
+
+// rowMap returns a row of the watched sheet keyed by column name, with its index under "RowIndex".
+// Columns past the end of the row are empty strings.
+func rowMap(currentRows [][]interface{}, rowIndex int) map[string]interface{} {
+	row := make(map[string]interface{})
+
+	for columnIndex := range currentRows[rowIndex] {
+		row["RowIndex"] = rowIndex
+		row[columnNameByIndex[columnIndex]] = currentRows[rowIndex][columnIndex]
+	}
+
+	for _, columnName := range columnNameByIndex {
+		if _, ok := row[columnName]; !ok {
+			row[columnName] = ""
+		}
+	}
+	return row
+}
+
 // getExcelColumnName function converts a column number to an Excel column name.
 // It returns the Excel column name.
 func getExcelColumnName(columnNumber int) string {
@@ -437,76 +804,141 @@ func replaceTokens(message string, currentRow map[string]interface{}) string {
 }
 
 // runGptSettingsOnRow processes the GPT settings on a row.
-// It fetches the GPT response,
-// updates the Google Sheet with the response using rate-limited function, and logs any errors.
+// It fetches the GPT response and writes it to the row's destination columns in one batch,
+// then records what was written. EXPAND and TABLE chunks write elsewhere, see runExpansionOnRow and runTableOnRow.
+// A response that fails validation is replaced by the chunk's fallback value or an error status.
 // It returns an error if an error occurred.
 func runGptSettingsOnRow(row map[string]interface{}, gptSettings ChunkSettings) error {
-	if err := gptLimiter.Wait(context.Background()); err != nil {
-		log.Printf("[GPT] rate limit error: %v", err)
-		return err
-	}
-
-	destinationColumnName := gptSettings.PromptColTo
-	destinationColumnLetter := columnLetterByName[destinationColumnName]
 	rowIndex, ok := row["RowIndex"].(int)
 	if !ok {
 		log.Printf("Error: RowIndex is not an integer")
 		return fmt.Errorf("error: RowIndex is not an integer")
 	}
-	destinationRange := fmt.Sprintf("%v%d", destinationColumnLetter, rowIndex+1)
 
-	vr := &sheets.ValueRange{
-		Values: [][]interface{}{{""}},
+	if gptSettings.Mode == chunkModeExpand {
+		return runExpansionOnRow(row, rowIndex, gptSettings)
+	}
+	if gptSettings.isTable() {
+		return runTableOnRow(row, rowIndex, gptSettings)
 	}
-	_, err := writeToSheetWithRateLimit(spreadsheetID, destinationRange, vr)
+
+	destinationColumns := gptSettings.destinationColumns()
+	writeColumns, skip := resolveManualEdits(row, rowIndex, gptSettings, destinationColumns)
+	if skip {
+		// The hand-edited row is kept, so a prompt change doesn't retry it on every poll
+		rememberDefinition(rowIndex, gptSettings)
+		return nil
+	}
+
+	err := writePlaceholders(row, rowIndex, gptSettings, writeColumns)
 	if err != nil {
 		log.Printf("Error updating Google Sheet: %v", err)
 		return err
 	}
 
-	systemMessage := replaceTokens(gptSettings.SystemMessage, row)
-	userMessage := replaceTokens(gptSettings.UserMessage, row)
-
-	client := openai.NewClient(os.Getenv("OPENAI_SECRET_KEY"))
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model: openai.GPT4,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: systemMessage,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userMessage,
-				},
-			},
-			MaxTokens:   gptSettings.MaxTokens,
-			Temperature: float32(gptSettings.Temperature),
-		},
-	)
+	// On any failure put back what the cells held before the placeholder was written
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		if _, err := restorePriorValues(rowIndex, gptSettings, writeColumns); err != nil {
+			log.Printf("Error restoring prior values: %v", err)
+		}
+	}()
+
+	var systemMessage, userMessage string
+	var request openai.ChatCompletionRequest
+	var result *completionResult
+	var steps *stepsResult
+	if len(gptSettings.Steps) > 0 {
+		steps, err = runSteps(row, rowIndex, gptSettings)
+		result = &steps.completionResult
+		request, systemMessage, userMessage = steps.Request, steps.SystemMessage, steps.UserMessage
+	} else {
+		systemMessage = renderTemplate(gptSettings.SystemMessage, row)
+		userMessage = renderTemplate(gptSettings.UserMessage, row)
+		request = newChatRequest(gptSettings, row, systemMessage, userMessage)
+		result, err = requestCompletion(gptSettings, request, fmt.Sprintf("Row #%d", rowIndex))
+	}
 
-	if err != nil {
-		log.Printf("[ERROR] getting GPT response: %v", err)
+	var values []interface{}
+	invalid, fallback := err.(*validationError)
+	if fallback {
+		values = gptSettings.fallbackValues()
+		if values == nil {
+			// Put the previous value back, or leave an error status in an empty cell
+			// so the row is not retried on every poll
+			completed = true
+			if _, restoreErr := restorePriorValues(rowIndex, gptSettings, writeColumns); restoreErr != nil {
+				log.Printf("Error restoring prior values: %v", restoreErr)
+			}
+			// The definition was tried, so a prompt change doesn't retry the row on every poll
+			rememberDefinition(rowIndex, gptSettings)
+			guardedColumn := writeColumns[gptSettings.guardedIndex()]
+			if guardedColumn != "" && (row[guardedColumn] == nil || row[guardedColumn] == "") {
+				errorStatus := &sheets.ValueRange{
+					Range:  fmt.Sprintf("%v%d", columnLetterByName[guardedColumn], rowIndex+1),
+					Values: [][]interface{}{{errorStatusPrefix + invalid.Err.Error()}},
+				}
+				if _, writeErr := writeToSheetWithRateLimit(spreadsheetID, errorStatus.Range, errorStatus); writeErr != nil {
+					log.Printf("Error updating Google Sheet: %v", writeErr)
+				} else {
+					rememberWrittenValues(rowIndex, map[string]interface{}{guardedColumn: errorStatus.Values[0][0]})
+				}
+			}
+			return err
+		}
+	} else if err != nil {
 		return err
+	} else {
+		values = result.Values
 	}
 
-	if len(resp.Choices) <= 0 {
-		log.Printf("No choices in the response")
-		return fmt.Errorf("no choices in the response")
+	var columns []string
+	var outputs []interface{}
+	for i, columnName := range writeColumns {
+		if columnName != "" {
+			columns = append(columns, columnName)
+			outputs = append(outputs, values[i])
+		}
+	}
+	if steps != nil {
+		stepColumns, stepOutputs := gptSettings.stepColumns(steps)
+		columns = append(columns, stepColumns...)
+		outputs = append(outputs, stepOutputs...)
 	}
 
-	output := resp.Choices[0].Message.Content
-	vr = &sheets.ValueRange{
-		Values: [][]interface{}{{output}},
+	data, cells, err := prepareCellWrites(gptSettings, rowIndex, columns, outputs)
+	if err != nil {
+		log.Printf("Error preparing output: %v", err)
+		return err
 	}
-	_, err = writeToSheetWithRateLimit(spreadsheetID, destinationRange, vr)
+	resp, err := batchWriteToSheetWithRateLimit(spreadsheetID, data, gptSettings.Safety.valueInputOption())
 	if err != nil {
 		log.Printf("Error updating Google Sheet: %v", err)
 		return err
 	}
-	log.Printf("Updated row #%v (%s) with value %s\n", rowIndex, destinationColumnName, output)
+	completed = true
+	clearPriorValues(rowIndex, writeColumns)
+	rememberWrittenValues(rowIndex, readBackValues(rowIndex, cells, resp))
+	rememberDefinition(rowIndex, gptSettings)
+	recordProvenance(rowIndex, gptSettings, request, result, cells, fallback)
+	model := request.Model
+	if result != nil {
+		model = result.Model
+	}
+	if err := recordHistory(row, rowIndex, gptSettings, cells, systemMessage, userMessage, model); err != nil {
+		log.Printf("Error recording history: %v", err)
+	}
+	if !fallback {
+		recordSample(row, rowIndex, gptSettings, systemMessage, userMessage, model, values)
+		runVariantOnRow(row, rowIndex, gptSettings, result, values[gptSettings.guardedIndex()])
+	}
+	routeRow(row, rowIndex, gptSettings, cells)
+	for i, value := range outputs {
+		log.Printf("Updated row #%v (%s) with value %v\n", rowIndex, columns[i], value)
+	}
 	// If the STATS are true, update the "Successful Completions" stat
 	if statsEnabled, ok := allSettings["GLOBAL"]["STATS"].(bool); ok && statsEnabled {
 		// Assume su is an instance of StatsUpdater from the stats.go file
@@ -546,6 +978,7 @@ func runGptSettingsOnRowWithSemaphore(row map[string]interface{}, gptSettings Ch
 		mutex.Lock()
 		err := runGptSettingsOnRow(row, gptSettings)
 		mutex.Unlock()
+		finishPromptChangeRerun(gptSettings.Name, row["RowIndex"], err)
 		if err != nil {
 			log.Printf("Error running GPT settings on row: %v", err)
 		}
@@ -577,6 +1010,24 @@ func writeToSheetWithRateLimit(spreadsheetID, range_ string, vr *sheets.ValueRan
 	return srv.Spreadsheets.Values.Update(spreadsheetID, range_, vr).ValueInputOption("USER_ENTERED").Do()
 }
 
+// batchWriteToSheetWithRateLimit waits for a token from the rate limiter, then writes several ranges to a Google Sheet
+// in a single request using the given value input option ("USER_ENTERED" or "RAW").
+// The response holds the written values as the sheet displays them.
+// It returns the response from the write operation and any error encountered.
+func batchWriteToSheetWithRateLimit(spreadsheetID string, data []*sheets.ValueRange, valueInputOption string) (*sheets.BatchUpdateValuesResponse, error) {
+	// Wait for a token from the rate limiter
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// Proceed with the write operation
+	return srv.Spreadsheets.Values.BatchUpdate(spreadsheetID, &sheets.BatchUpdateValuesRequest{
+		ValueInputOption:        valueInputOption,
+		Data:                    data,
+		IncludeValuesInResponse: true,
+	}).Do()
+}
+
 // runMainLoop runs the main loop of the program. It fetches the values from the Google Sheet,
 // detects any changes, updates the previous state, and sleeps for the specified refresh frequency
 // before fetching the values again. It also updates the "Total Rows Processed" stat if the STATS setting is true.
@@ -601,6 +1052,16 @@ func runMainLoop() error {
 				continue
 			}
 			lastReadSettings = time.Now()
+
+			err = processCommand()
+			if err != nil {
+				handleError(err) // Call handleError function instead of logging the error directly
+			}
+
+			err = pruneHistory()
+			if err != nil {
+				handleError(err) // Call handleError function instead of logging the error directly
+			}
 		}
 
 		resp, err := getSheetValuesWithSemaphore(spreadsheetID, allSettings["GLOBAL"]["SHEET_NAME"].(string))
@@ -651,6 +1112,11 @@ func runMainLoop() error {
 			lastColumnCheck = time.Now()
 		}
 
+		err = refreshLookupTabs()
+		if err != nil {
+			handleError(err) // Call handleError function instead of logging the error directly
+		}
+
 		err = detectChanges(resp.Values, shouldCheckForNewColumns)
 		if err != nil {
 			handleError(err) // Call handleError function instead of logging the error directly
@@ -665,7 +1131,6 @@ func runMainLoop() error {
 		}
 		time.Sleep(time.Duration(sleepFreq * float64(time.Second)))
 	}
-	return nil
 }
 
 // getSheetValuesWithSemaphore is a wrapper function for readFromSheetWithRateLimit
@@ -704,10 +1169,21 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error setting up environment: %v", err)
 	}
+	if len(os.Args) > 1 {
+		if err := runCLI(os.Args[1:]); err != nil {
+			log.Fatalf("Error running %s: %v", os.Args[1], err)
+		}
+		return
+	}
+	setupStats()
+	go serveAdmin()
+
+	loadEnginePaused()
 	err = readSettings()
 	if err != nil {
 		log.Fatalf("Error reading settings: %v", err)
 	}
+	restoreLeftoverPriorValues()
 
 	err = runMainLoop()
 	if err != nil {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Policies for VARx_ON_MANUAL_EDIT, applied when an output cell no longer holds the value the engine wrote.
+const (
+	manualEditSkip      = "skip"
+	manualEditOverwrite = "overwrite"
+	manualEditShadow    = "shadow"
+)
+
+// parseManualEditPolicy validates an ON_MANUAL_EDIT value.
+// It returns an error if the value is not one of the known policies.
+func parseManualEditPolicy(value string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(value))
+	switch policy {
+	case manualEditSkip, manualEditOverwrite, manualEditShadow:
+		return policy, nil
+	}
+	return "", fmt.Errorf("error: ON_MANUAL_EDIT must be skip, overwrite or shadow. It is %s", value)
+}
+
+// writtenValueKey returns the Redis key holding the last value the engine wrote to a cell.
+func writtenValueKey(rowIndex int, columnName string) string {
+	return fmt.Sprintf("written:%d:%d", rowIndex, columnIndexByName[columnName])
+}
+
+// rememberWrittenValues stores the values the engine wrote to a row, keyed by column name,
+// so later runs can tell whether a human has edited them since.
+func rememberWrittenValues(rowIndex int, cells map[string]interface{}) {
+	for columnName, value := range cells {
+		err := redisClient.Set(writtenValueKey(rowIndex, columnName), fmt.Sprint(value), 0).Err()
+		if err != nil {
+			log.Printf("Error setting value in Redis: %v", err)
+		}
+	}
+}
+
+// readBackValues returns the cells written to a row as the sheet displays them, taken from the values returned
+// by the batch write, falling back to the written value for cells the response doesn't hold.
+// Comparing against what the sheet shows keeps values it reformats, such as booleans and numbers, from looking edited.
+func readBackValues(rowIndex int, cells map[string]interface{}, resp *sheets.BatchUpdateValuesResponse) map[string]interface{} {
+	values := make(map[string]interface{}, len(cells))
+	for columnName, value := range cells {
+		values[columnName] = value
+	}
+	if resp == nil {
+		return values
+	}
+	for _, response := range resp.Responses {
+		if response.UpdatedData == nil {
+			continue
+		}
+		start, _, _ := strings.Cut(response.UpdatedData.Range, ":")
+		_, columnIndex, rowNumber, err := parseA1Cell(start)
+		if err != nil || rowNumber != rowIndex+1 {
+			continue
+		}
+		for _, row := range response.UpdatedData.Values {
+			for i, value := range row {
+				if columnName, ok := columnNameByIndex[columnIndex+i]; ok {
+					if _, written := cells[columnName]; written {
+						values[columnName] = value
+					}
+				}
+			}
+			break
+		}
+	}
+	return values
+}
+
+// normalizeCellValue returns a cell value in a form that doesn't depend on how the sheet formats it:
+// trimmed, booleans upper case and numbers in their shortest form.
+func normalizeCellValue(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, "true") || strings.EqualFold(value, "false") {
+		return strings.ToUpper(value)
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return value
+}
+
+// isManuallyEdited reports whether a cell holds something other than the last value the engine wrote to it.
+// Empty cells and cells the engine has never written are not considered edited.
+// Both values are normalized, so formatting the sheet applies on its own is not an edit.
+func isManuallyEdited(row map[string]interface{}, rowIndex int, columnName string) bool {
+	current := fmt.Sprint(row[columnName])
+	if row[columnName] == nil || current == "" {
+		return false
+	}
+
+	written, err := redisClient.Get(writtenValueKey(rowIndex, columnName)).Result()
+	if err == redis.Nil {
+		return false
+	} else if err != nil {
+		log.Printf("Error getting value from Redis: %v", err)
+		return false
+	}
+
+	return normalizeCellValue(written) != normalizeCellValue(current)
+}
+
+// resolveManualEdits applies the chunk's ON_MANUAL_EDIT policy to its destination columns.
+// It returns the column each destination value should be written to, where an empty name means the value is
+// not written, and whether the whole run should be skipped.
+func resolveManualEdits(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, destinationColumns []string) ([]string, bool) {
+	writeColumns := make([]string, len(destinationColumns))
+	copy(writeColumns, destinationColumns)
+
+	policy := gptSettings.OnManualEdit
+	if policy == "" {
+		policy = manualEditSkip
+	}
+	if policy == manualEditOverwrite {
+		return writeColumns, false
+	}
+
+	for i, columnName := range destinationColumns {
+		// A placeholder left behind by an interrupted run is not an edit
+		if gptSettings.Placeholder != "" && fmt.Sprint(row[columnName]) == gptSettings.Placeholder {
+			continue
+		}
+		if !isManuallyEdited(row, rowIndex, columnName) {
+			continue
+		}
+
+		if policy == manualEditSkip || gptSettings.ShadowColumn == "" {
+			log.Printf("Row #%d (%s) was edited by hand, skipping '%s'\n", rowIndex, columnName, gptSettings.Name)
+			return nil, true
+		}
+
+		if columnName == gptSettings.PromptColTo {
+			log.Printf("Row #%d (%s) was edited by hand, writing '%s' to %s\n", rowIndex, columnName, gptSettings.Name, gptSettings.ShadowColumn)
+			writeColumns[i] = gptSettings.ShadowColumn
+		} else {
+			log.Printf("Row #%d (%s) was edited by hand, leaving it untouched\n", rowIndex, columnName)
+			writeColumns[i] = ""
+		}
+	}
+
+	return writeColumns, false
+}
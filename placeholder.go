@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// placeholderKeep is the VARx_PLACEHOLDER value that leaves the previous output in place while generating.
+const placeholderKeep = "keep-old-value"
+
+// priorValueKey returns the Redis key holding the value a cell had before the engine started regenerating it.
+func priorValueKey(rowIndex int, columnName string) string {
+	return fmt.Sprintf("prior:%d:%d", rowIndex, columnIndexByName[columnName])
+}
+
+// keepsOldValue reports whether the chunk leaves its output cells untouched until the new value is ready.
+func (c ChunkSettings) keepsOldValue() bool {
+	return strings.EqualFold(strings.TrimSpace(c.Placeholder), placeholderKeep)
+}
+
+// writePlaceholders saves the current value of each destination cell in Redis and then writes the chunk's
+// placeholder to those cells. Chunks that keep the old value write nothing.
+// It returns an error if the prior values could not be saved or the placeholders could not be written.
+func writePlaceholders(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, columns []string) error {
+	if gptSettings.keepsOldValue() {
+		return nil
+	}
+
+	var placeholders []*sheets.ValueRange
+	for _, columnName := range columns {
+		if columnName == "" {
+			continue
+		}
+		prior := ""
+		if row[columnName] != nil {
+			prior = fmt.Sprint(row[columnName])
+		}
+		if err := redisClient.Set(priorValueKey(rowIndex, columnName), prior, 0).Err(); err != nil {
+			return fmt.Errorf("error saving prior value in Redis: %v", err)
+		}
+		placeholders = append(placeholders, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%v%d", columnLetterByName[columnName], rowIndex+1),
+			Values: [][]interface{}{{gptSettings.Placeholder}},
+		})
+	}
+
+	_, err := batchWriteToSheetWithRateLimit(spreadsheetID, placeholders, "RAW")
+	return err
+}
+
+// restorePriorValues writes the values saved by writePlaceholders back to the destination cells
+// after a run failed, so the previous good value is not lost.
+// It returns the restored values keyed by column name, or an error if they could not be written.
+func restorePriorValues(rowIndex int, gptSettings ChunkSettings, columns []string) (map[string]string, error) {
+	restored := make(map[string]string)
+	if gptSettings.keepsOldValue() {
+		return restored, nil
+	}
+
+	var data []*sheets.ValueRange
+	for _, columnName := range columns {
+		if columnName == "" {
+			continue
+		}
+		prior, err := redisClient.Get(priorValueKey(rowIndex, columnName)).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error getting prior value from Redis: %v", err)
+		}
+		restored[columnName] = prior
+
+		value := prior
+		if escaped, changed := escapeFormula(prior); changed {
+			value = escaped
+		}
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%v%d", columnLetterByName[columnName], rowIndex+1),
+			Values: [][]interface{}{{value}},
+		})
+	}
+	if len(data) == 0 {
+		return restored, nil
+	}
+
+	if _, err := batchWriteToSheetWithRateLimit(spreadsheetID, data, "USER_ENTERED"); err != nil {
+		return nil, err
+	}
+	log.Printf("Restored %d prior value(s) of row #%d for '%s'\n", len(data), rowIndex, gptSettings.Name)
+	clearPriorValues(rowIndex, columns)
+	return restored, nil
+}
+
+// clearPriorValues removes the values saved by writePlaceholders once they are no longer needed.
+func clearPriorValues(rowIndex int, columns []string) {
+	for _, columnName := range columns {
+		if columnName == "" {
+			continue
+		}
+		if err := redisClient.Del(priorValueKey(rowIndex, columnName)).Err(); err != nil {
+			log.Printf("Error deleting value in Redis: %v", err)
+		}
+	}
+}
+
+// restoreLeftoverPriorValues puts back the prior values of runs that never finished because the engine stopped
+// mid-completion. It runs at startup, when no run is in flight, so every prior:* key left in Redis is a leftover.
+// A cell is restored if it still holds a chunk's placeholder or is empty; a cell edited since keeps its value.
+func restoreLeftoverPriorValues() {
+	placeholders := make(map[string]bool)
+	for _, gptSettings := range gptSettingsByName {
+		if !gptSettings.keepsOldValue() {
+			placeholders[gptSettings.Placeholder] = true
+		}
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := redisClient.Scan(cursor, "prior:*", 100).Result()
+		if err != nil {
+			log.Printf("Error scanning Redis: %v", err)
+			return
+		}
+		for _, key := range keys {
+			restoreLeftoverPriorValue(key, placeholders)
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+// restoreLeftoverPriorValue restores the cell of one leftover prior:<row>:<column> key and removes the key.
+func restoreLeftoverPriorValue(key string, placeholders map[string]bool) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 {
+		return
+	}
+	rowIndex, rowErr := strconv.Atoi(parts[1])
+	columnIndex, columnErr := strconv.Atoi(parts[2])
+	if rowErr != nil || columnErr != nil {
+		return
+	}
+	defer func() {
+		if err := redisClient.Del(key).Err(); err != nil {
+			log.Printf("Error deleting value in Redis: %v", err)
+		}
+	}()
+
+	prior, err := redisClient.Get(key).Result()
+	if err != nil {
+		log.Printf("Error getting prior value from Redis: %v", err)
+		return
+	}
+	range_ := fmt.Sprintf("'%s'!%s%d", sheetTitle(allSettings["GLOBAL"]["SHEET_NAME"].(string)), getExcelColumnName(columnIndex+1), rowIndex+1)
+	resp, err := readFromSheetWithRateLimit(spreadsheetID, range_)
+	if err != nil {
+		log.Printf("Error reading %s: %v", range_, err)
+		return
+	}
+	current := ""
+	if len(resp.Values) > 0 && len(resp.Values[0]) > 0 {
+		current = fmt.Sprint(resp.Values[0][0])
+	}
+	if current != "" && !placeholders[current] {
+		return
+	}
+
+	value := prior
+	if escaped, changed := escapeFormula(prior); changed {
+		value = escaped
+	}
+	vr := &sheets.ValueRange{
+		Values: [][]interface{}{{value}},
+	}
+	if _, err := writeToSheetWithRateLimit(spreadsheetID, range_, vr); err != nil {
+		log.Printf("Error updating Google Sheet: %v", err)
+		return
+	}
+	log.Printf("Restored the prior value of %s left by an interrupted run\n", range_)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PostProcessor is one step of a chunk's VARx_POSTPROCESS chain.
+type PostProcessor struct {
+	Name     string
+	Argument string
+	apply    func(string) string
+}
+
+var markdownFencePattern = regexp.MustCompile("(?s)^```[A-Za-z0-9_-]*\\s*\\n?(.*?)\\n?```$")
+var markdownHeadingPattern = regexp.MustCompile(`(?m)^#{1,6}\s+`)
+var markdownEmphasisPattern = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+var markdownListPattern = regexp.MustCompile(`(?m)^\s*[-*+]\s+`)
+
+// quotePairs lists the opening and closing quotes removed by strip_quotes.
+var quotePairs = [][2]string{{`"`, `"`}, {`'`, `'`}, {"`", "`"}, {"“", "”"}, {"‘", "’"}, {"«", "»"}}
+
+// postProcessorNames lists the processors that can be used in VARx_POSTPROCESS.
+var postProcessorNames = map[string]bool{
+	"trim":           true,
+	"strip_quotes":   true,
+	"strip_markdown": true,
+	"strip_prefix":   true,
+	"regex_extract":  true,
+	"lowercase":      true,
+	"uppercase":      true,
+	"truncate":       true,
+}
+
+// parsePostProcessors parses a comma separated VARx_POSTPROCESS value such as
+// "trim,strip_quotes,regex_extract:(\d+),truncate:500". Arguments follow a colon and may contain commas,
+// a comma only starts a new processor when it is followed by a known processor name.
+// It returns an error if a processor is unknown or its argument is invalid.
+func parsePostProcessors(value string) ([]PostProcessor, error) {
+	var steps []string
+	for _, part := range strings.Split(value, ",") {
+		name := strings.TrimSpace(part)
+		if i := strings.Index(name, ":"); i >= 0 {
+			name = name[:i]
+		}
+		if postProcessorNames[name] || len(steps) == 0 {
+			steps = append(steps, strings.TrimLeft(part, " "))
+			continue
+		}
+		steps[len(steps)-1] += "," + part
+	}
+
+	var processors []PostProcessor
+	for _, step := range steps {
+		name, argument := step, ""
+		if i := strings.Index(step, ":"); i >= 0 {
+			name, argument = step[:i], step[i+1:]
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		processor := PostProcessor{Name: name, Argument: argument}
+		switch name {
+		case "trim":
+			processor.apply = strings.TrimSpace
+		case "strip_quotes":
+			processor.apply = stripQuotes
+		case "strip_markdown":
+			processor.apply = stripMarkdown
+		case "strip_prefix":
+			if argument == "" {
+				return nil, fmt.Errorf("strip_prefix needs the prefix to remove")
+			}
+			processor.apply = func(s string) string {
+				trimmed := strings.TrimLeft(s, " \t\r\n")
+				if len(trimmed) >= len(argument) && strings.EqualFold(trimmed[:len(argument)], argument) {
+					return strings.TrimLeft(trimmed[len(argument):], " \t")
+				}
+				return s
+			}
+		case "regex_extract":
+			pattern, err := regexp.Compile(argument)
+			if err != nil {
+				return nil, fmt.Errorf("regex_extract pattern is invalid: %v", err)
+			}
+			processor.apply = func(s string) string {
+				match := pattern.FindStringSubmatch(s)
+				if match == nil {
+					return s
+				}
+				if len(match) > 1 {
+					return match[1]
+				}
+				return match[0]
+			}
+		case "lowercase":
+			processor.apply = strings.ToLower
+		case "uppercase":
+			processor.apply = strings.ToUpper
+		case "truncate":
+			limit, err := strconv.Atoi(strings.TrimSpace(argument))
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("truncate needs a positive length, got %q", argument)
+			}
+			processor.apply = func(s string) string {
+				runes := []rune(s)
+				if len(runes) <= limit {
+					return s
+				}
+				return string(runes[:limit])
+			}
+		default:
+			return nil, fmt.Errorf("unknown post-processor %q", name)
+		}
+		processors = append(processors, processor)
+	}
+
+	return processors, nil
+}
+
+// postProcess runs an output value through a chain of post-processors.
+// Values that are not strings, such as numbers from a structured output, are returned unchanged.
+func postProcess(processors []PostProcessor, value interface{}) interface{} {
+	output, ok := value.(string)
+	if !ok {
+		return value
+	}
+	for _, processor := range processors {
+		output = processor.apply(output)
+	}
+	return output
+}
+
+// stripQuotes removes one pair of matching quotes surrounding a string.
+func stripQuotes(s string) string {
+	trimmed := strings.TrimSpace(s)
+	for _, pair := range quotePairs {
+		if len(trimmed) >= len(pair[0])+len(pair[1]) && strings.HasPrefix(trimmed, pair[0]) && strings.HasSuffix(trimmed, pair[1]) {
+			return trimmed[len(pair[0]) : len(trimmed)-len(pair[1])]
+		}
+	}
+	return s
+}
+
+// stripMarkdown removes a surrounding code fence, headings, list bullets and bold markers.
+func stripMarkdown(s string) string {
+	trimmed := strings.TrimSpace(s)
+	if match := markdownFencePattern.FindStringSubmatch(trimmed); match != nil {
+		trimmed = match[1]
+	}
+	trimmed = markdownHeadingPattern.ReplaceAllString(trimmed, "")
+	trimmed = markdownListPattern.ReplaceAllString(trimmed, "")
+	trimmed = markdownEmphasisPattern.ReplaceAllString(trimmed, "$2")
+	return trimmed
+}
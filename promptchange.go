@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Policies for VARx_ON_PROMPT_CHANGE, applied to outputs generated with an earlier definition of the chunk.
+const (
+	promptChangeIgnore      = "ignore"
+	promptChangeRerunAll    = "rerun-all"
+	promptChangeNextTrigger = "rerun-on-next-trigger"
+)
+
+// parsePromptChangePolicy validates an ON_PROMPT_CHANGE value.
+// It returns an error if the value is not one of the known policies.
+func parsePromptChangePolicy(value string) (string, error) {
+	policy := strings.ToLower(strings.TrimSpace(value))
+	switch policy {
+	case promptChangeIgnore, promptChangeRerunAll, promptChangeNextTrigger:
+		return policy, nil
+	}
+	return "", fmt.Errorf("error: ON_PROMPT_CHANGE must be ignore, rerun-all or rerun-on-next-trigger. It is %s", value)
+}
+
+// definitionHash hashes the settings that shape a chunk's output: its prompts and conversation turns, model, sampling settings,
+// examples, output schema, post-processing steps with their arguments, sanitizing and guardrails.
+func (c ChunkSettings) definitionHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "system:%s\nuser:%s\ntemperature:%v\nmax_tokens:%d\n", c.SystemMessage, c.UserMessage, c.Temperature, c.MaxTokens)
+	for _, turn := range c.Messages {
+		fmt.Fprintf(h, "turn:%s:%s\n", turn.Role, turn.Template)
+	}
+	if c.Model != "" {
+		fmt.Fprintf(h, "model:%s\n", c.Model)
+	}
+	if c.OutputSchema != nil {
+		fmt.Fprintf(h, "schema:%s\n", c.OutputSchema.Parameters)
+	}
+	if c.Examples.Tab != "" {
+		fmt.Fprintf(h, "examples:%s:%d:%s:%s\n", c.Examples.Tab, c.Examples.Max, c.Examples.Select, c.Examples.OutputColumn)
+	}
+	for _, processor := range c.PostProcess {
+		fmt.Fprintf(h, "postprocess:%s:%s\n", processor.Name, processor.Argument)
+	}
+	if c.Safety.Mode != "" {
+		fmt.Fprintf(h, "sanitize:%s\n", c.Safety.Mode)
+	}
+	if guardrails := c.Guardrails; guardrails.enabled() {
+		fmt.Fprintf(h, "allowed:%s\nmax_length:%d\n", strings.Join(guardrails.AllowedValues, ","), guardrails.MaxLength)
+		if guardrails.Pattern != nil {
+			fmt.Fprintf(h, "pattern:%s\n", guardrails.Pattern)
+		}
+		if guardrails.MinValue != nil {
+			fmt.Fprintf(h, "min:%v\n", *guardrails.MinValue)
+		}
+		if guardrails.MaxValue != nil {
+			fmt.Fprintf(h, "max:%v\n", *guardrails.MaxValue)
+		}
+		if guardrails.Fallback != nil {
+			fmt.Fprintf(h, "fallback:%s\n", *guardrails.Fallback)
+		}
+	}
+	if len(c.Tools.Names) > 0 {
+		fmt.Fprintf(h, "tools:%s:%s:%d\n", strings.Join(c.Tools.Names, ","), strings.Join(c.Tools.Tabs, ","), c.Tools.maxTurns())
+	}
+	for _, step := range c.steps() {
+		fmt.Fprintf(h, "step:%s\nsystem:%s\nuser:%s\nstop_on:%s\n", step.Name, step.SystemMessage, step.UserMessage, step.StopOn)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// definitionValue returns what is stored for every cell generated with the chunk's current definition.
+func (c ChunkSettings) definitionValue() string {
+	return c.Name + ":" + c.definitionHash()
+}
+
+// definitionKeys returns the Redis keys holding the definition a row's outputs were generated with:
+// one per destination cell, or a single per-row key for chunks that write outside the row.
+func (c ChunkSettings) definitionKeys(rowIndex int) []string {
+	if c.Mode == chunkModeExpand || c.isTable() {
+		return []string{fmt.Sprintf("definition:%s:row:%d", c.Name, rowIndex)}
+	}
+	var keys []string
+	for _, columnName := range c.destinationColumns() {
+		if columnIndex, ok := columnIndexByName[columnName]; ok && columnName != "" {
+			keys = append(keys, fmt.Sprintf("definition:%d:%d", rowIndex, columnIndex))
+		}
+	}
+	return keys
+}
+
+// rememberDefinition stores the chunk's current definition for a row it ran on. It is stored under the keys
+// definitionState reads, the chunk's destination columns, even when the output went to the shadow column.
+func rememberDefinition(rowIndex int, gptSettings ChunkSettings) {
+	for _, key := range gptSettings.definitionKeys(rowIndex) {
+		if err := redisClient.Set(key, gptSettings.definitionValue(), 0).Err(); err != nil {
+			log.Printf("Error setting value in Redis: %v", err)
+		}
+	}
+}
+
+// definitionState reports whether the chunk has generated outputs on a row and whether any of them was generated
+// with an earlier definition of the chunk. Outputs from before definitions were recorded are never stale.
+func (c ChunkSettings) definitionState(rowIndex int) (generated bool, stale bool) {
+	current := c.definitionValue()
+	for _, key := range c.definitionKeys(rowIndex) {
+		value, err := redisClient.Get(key).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			log.Printf("Error getting value from Redis: %v", err)
+			continue
+		}
+		if !strings.HasPrefix(value, c.Name+":") {
+			continue
+		}
+		generated = true
+		if value != current {
+			stale = true
+		}
+	}
+	return generated, stale
+}
+
+// promptChangeReruns holds the "chunk:row" keys of prompt change reruns that have been dispatched but not finished,
+// so a row is not dispatched again on every poll while its rerun is running.
+var promptChangeReruns sync.Map
+
+// promptChangeRetryDelay is how long a row whose run failed waits before a prompt change reruns it again.
+const promptChangeRetryDelay = 10 * time.Minute
+
+// promptChangeRetryAt maps the "chunk:row" keys of rows whose last run failed to when a prompt change may rerun them.
+var promptChangeRetryAt sync.Map
+
+// startPromptChangeRerun marks a row's prompt change rerun as running.
+// It returns false if the rerun is already running, or the row's last run failed less than
+// promptChangeRetryDelay ago.
+func startPromptChangeRerun(chunkName string, rowIndex int) bool {
+	key := fmt.Sprintf("%s:%d", chunkName, rowIndex)
+	if retryAt, ok := promptChangeRetryAt.Load(key); ok && time.Now().Before(retryAt.(time.Time)) {
+		return false
+	}
+	_, running := promptChangeReruns.LoadOrStore(key, true)
+	return !running
+}
+
+// finishPromptChangeRerun clears the running mark of a row's run, and records when a prompt change may rerun
+// the row if the run failed.
+func finishPromptChangeRerun(chunkName string, rowIndex interface{}, err error) {
+	key := fmt.Sprintf("%s:%v", chunkName, rowIndex)
+	promptChangeReruns.Delete(key)
+	if err != nil {
+		promptChangeRetryAt.Store(key, time.Now().Add(promptChangeRetryDelay))
+	} else {
+		promptChangeRetryAt.Delete(key)
+	}
+}
+
+// promptChangeProgress counts, per chunk, the rows generated by the chunk and how many of them are up to date.
+type promptChangeProgress map[string]*[2]int
+
+// add counts a generated row.
+func (p promptChangeProgress) add(chunkName string, stale bool) {
+	if p[chunkName] == nil {
+		p[chunkName] = &[2]int{}
+	}
+	p[chunkName][1]++
+	if !stale {
+		p[chunkName][0]++
+	}
+}
+
+// record writes the progress of every chunk as "VAR3 80/120" to the "Prompt Change Progress" stat.
+func (p promptChangeProgress) record() {
+	if len(p) == 0 {
+		return
+	}
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d/%d", name, p[name][0], p[name][1])
+	}
+	recordStat("Prompt Change Progress", strings.Join(parts, ", "))
+}
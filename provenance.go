@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Provenance records how a generated cell was produced.
+type Provenance struct {
+	Cell             string     `json:"cell"`
+	Chunk            string     `json:"chunk"`
+	Definition       string     `json:"definition"`
+	Model            string     `json:"model"`
+	Temperature      float32    `json:"temperature"`
+	PromptTokens     int        `json:"prompt_tokens"`
+	CompletionTokens int        `json:"completion_tokens"`
+	LatencyMs        int64      `json:"latency_ms"`
+	Timestamp        string     `json:"timestamp"`
+	InputHash        string     `json:"input_hash"`
+	Fallback         bool       `json:"fallback,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// note returns the provenance as the text of a cell note.
+func (p Provenance) note() string {
+	note := fmt.Sprintf("Generated by %s (definition %s)\nModel: %s, temperature %v\nTokens: %d prompt, %d completion\nLatency: %dms\nAt: %s\nInput: %s",
+		p.Chunk, p.Definition, p.Model, p.Temperature, p.PromptTokens, p.CompletionTokens, p.LatencyMs, p.Timestamp, p.InputHash)
+	if p.Fallback {
+		note += "\nFallback value, the response failed validation"
+	}
+	for _, call := range p.ToolCalls {
+		note += fmt.Sprintf("\nTool: %s(%s)", call.Name, call.Arguments)
+	}
+	return note
+}
+
+// provenanceKey returns the Redis key holding the provenance of a cell.
+func provenanceKey(rowIndex int, columnIndex int) string {
+	return fmt.Sprintf("provenance:%d:%d", rowIndex, columnIndex)
+}
+
+// inputHash hashes the messages a request was sent with, so outputs generated from the same input can be matched.
+func inputHash(request openai.ChatCompletionRequest) string {
+	h := sha256.New()
+	for _, message := range request.Messages {
+		fmt.Fprintf(h, "%s:%s\n", message.Role, message.Content)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// recordProvenance stores the provenance of the cells written on a row, keyed by column name,
+// and writes it as a note on each cell if the global PROVENANCE_NOTES setting is true.
+func recordProvenance(rowIndex int, gptSettings ChunkSettings, request openai.ChatCompletionRequest, result *completionResult, cells map[string]interface{}, fallback bool) {
+	provenance := Provenance{
+		Chunk:       gptSettings.Name,
+		Definition:  gptSettings.definitionHash(),
+		Model:       request.Model,
+		Temperature: gptSettings.Temperature,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		InputHash:   inputHash(request),
+		Fallback:    fallback,
+	}
+	if result != nil {
+		provenance.Model = result.Model
+		provenance.PromptTokens = result.Usage.PromptTokens
+		provenance.CompletionTokens = result.Usage.CompletionTokens
+		provenance.LatencyMs = result.Latency.Milliseconds()
+		provenance.ToolCalls = result.ToolCalls
+	}
+
+	notes := make(map[int]string)
+	for columnName := range cells {
+		columnIndex, ok := columnIndexByName[columnName]
+		if !ok {
+			continue
+		}
+		provenance.Cell = fmt.Sprintf("%s%d", getExcelColumnName(columnIndex+1), rowIndex+1)
+		b, err := json.Marshal(provenance)
+		if err != nil {
+			log.Printf("Error encoding provenance: %v", err)
+			continue
+		}
+		if err := redisClient.Set(provenanceKey(rowIndex, columnIndex), string(b), 0).Err(); err != nil {
+			log.Printf("Error setting value in Redis: %v", err)
+		}
+		notes[columnIndex] = provenance.note()
+	}
+
+	if enabled, ok := allSettings["GLOBAL"]["PROVENANCE_NOTES"].(bool); ok && enabled && len(notes) > 0 {
+		if err := writeCellNotes(rowIndex, notes); err != nil {
+			log.Printf("Error writing provenance notes: %v", err)
+		}
+	}
+}
+
+// writeCellNotes sets the notes of cells of a row of the watched sheet, keyed by column index.
+// It returns an error if the sheet could not be updated.
+func writeCellNotes(rowIndex int, notes map[int]string) error {
+	sheetID, err := getSheetID(sheetTitle(allSettings["GLOBAL"]["SHEET_NAME"].(string)))
+	if err != nil {
+		return err
+	}
+
+	var requests []*sheets.Request
+	for columnIndex, note := range notes {
+		requests = append(requests, &sheets.Request{
+			UpdateCells: &sheets.UpdateCellsRequest{
+				Range: &sheets.GridRange{
+					SheetId:          sheetID,
+					StartRowIndex:    int64(rowIndex),
+					EndRowIndex:      int64(rowIndex + 1),
+					StartColumnIndex: int64(columnIndex),
+					EndColumnIndex:   int64(columnIndex + 1),
+				},
+				Rows:   []*sheets.RowData{{Values: []*sheets.CellData{{Note: note}}}},
+				Fields: "note",
+			},
+		})
+	}
+
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+	_, err = srv.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Do()
+	return err
+}
+
+// explainCell returns the provenance recorded for a cell of the watched sheet, given as an A1 reference such as "C5".
+// It returns an error if the reference is invalid or nothing was recorded for the cell.
+func explainCell(reference string) (*Provenance, error) {
+	_, columnIndex, rowNumber, err := parseA1Cell(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := redisClient.Get(provenanceKey(rowNumber-1, columnIndex)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("no provenance recorded for %s", reference)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read provenance of %s: %v", reference, err)
+	}
+
+	var provenance Provenance
+	if err := json.Unmarshal([]byte(value), &provenance); err != nil {
+		return nil, fmt.Errorf("unable to decode provenance of %s: %v", reference, err)
+	}
+	return &provenance, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// routeWildcard is the ROUTE value that matches anything no other rule matched.
+const routeWildcard = "*"
+
+// routedByKey is the row key listing the chunks that routed a row to the chunk running on it,
+// so routes that lead back to an earlier chunk are not followed.
+const routedByKey = "RoutedBy"
+
+// RouteRule sends rows whose route column holds Value to the chunk named Chunk.
+type RouteRule struct {
+	Value string
+	Chunk string
+}
+
+// ChunkRoute picks the chunk to run on a row after the chunk finished, from the value of a column.
+// Targets holds the settings of the chunks its rules name, resolved when the settings are read.
+type ChunkRoute struct {
+	Column  string
+	Rules   []RouteRule
+	Targets map[string]ChunkSettings
+}
+
+// parseRoute parses a ROUTE value such as "Category:complaint->VAR5,question->VAR6,*->VAR7".
+// It returns an error if the value has no column or a rule is not value->chunk.
+func parseRoute(value string) (*ChunkRoute, error) {
+	column, rules, ok := strings.Cut(value, ":")
+	column = strings.TrimSpace(column)
+	if !ok || column == "" {
+		return nil, fmt.Errorf("error: ROUTE must be column:value->chunk,... It is %s", value)
+	}
+
+	route := &ChunkRoute{Column: column}
+	for _, item := range strings.Split(rules, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		match, chunk, ok := strings.Cut(item, "->")
+		match, chunk = strings.TrimSpace(match), strings.TrimSpace(chunk)
+		if !ok || match == "" || chunk == "" {
+			return nil, fmt.Errorf("error: ROUTE rule %q is not value->chunk", item)
+		}
+		route.Rules = append(route.Rules, RouteRule{Value: match, Chunk: chunk})
+	}
+	if len(route.Rules) == 0 {
+		return nil, fmt.Errorf("error: ROUTE has no rules")
+	}
+	return route, nil
+}
+
+// target returns the chunk a value routes to: the first rule whose value equals it, ignoring case,
+// or the wildcard rule. It returns false if no rule matches.
+func (r *ChunkRoute) target(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	for _, rule := range r.Rules {
+		if rule.Value != routeWildcard && strings.EqualFold(rule.Value, value) {
+			return rule.Chunk, true
+		}
+	}
+	for _, rule := range r.Rules {
+		if rule.Value == routeWildcard {
+			return rule.Chunk, true
+		}
+	}
+	return "", false
+}
+
+// resolveRoutes looks up the chunks every ROUTE leads to once the settings are read, so jobs never read
+// gptSettingsByName while the next settings read rebuilds it.
+func resolveRoutes() {
+	for name, gptSettings := range gptSettingsByName {
+		if gptSettings.Route == nil {
+			continue
+		}
+		gptSettings.Route.Targets = make(map[string]ChunkSettings)
+		for _, rule := range gptSettings.Route.Rules {
+			target, ok := gptSettingsByName[rule.Chunk]
+			if !ok {
+				log.Printf("Error: route of '%s' leads to '%s', which does not exist", name, rule.Chunk)
+				continue
+			}
+			gptSettings.Route.Targets[rule.Chunk] = target
+		}
+	}
+}
+
+// routeRow dispatches the chunk a row routes to after a chunk with a ROUTE wrote its cells, without waiting for the
+// next poll. The route column is read from the written cells, or from the row if the chunk did not write it, and
+// the routed chunk sees the row with the written cells. The routed chunk's WHERE filter applies as on a poll, and
+// a routed chunk that is paused or inactive is queued like a trigger.
+// Routed chunks should not also trigger on the route column, or they run again on the next poll.
+func routeRow(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, cells map[string]interface{}) {
+	if gptSettings.Route == nil {
+		return
+	}
+	value, ok := cells[gptSettings.Route.Column]
+	if !ok {
+		value = row[gptSettings.Route.Column]
+	}
+	if value == nil {
+		value = ""
+	}
+	chunkName, ok := gptSettings.Route.target(fmt.Sprint(value))
+	if !ok {
+		log.Printf("Row #%d '%s' value %q of '%s' matches no route\n", rowIndex, gptSettings.Route.Column, value, gptSettings.Name)
+		return
+	}
+
+	routedBy, _ := row[routedByKey].([]string)
+	routedBy = append(append([]string{}, routedBy...), gptSettings.Name)
+	for _, name := range routedBy {
+		if name == chunkName {
+			log.Printf("Error: route of '%s' on row #%d leads back to '%s'", gptSettings.Name, rowIndex, chunkName)
+			return
+		}
+	}
+	target, ok := gptSettings.Route.Targets[chunkName]
+	if !ok {
+		log.Printf("Error: route of '%s' leads to '%s', which does not exist", gptSettings.Name, chunkName)
+		return
+	}
+	if globalPaused() || !target.isActive(time.Now()) {
+		log.Printf("Row #%d routed to '%s', which is paused or inactive, queueing\n", rowIndex, chunkName)
+		queueTrigger(chunkName, rowIndex)
+		return
+	}
+
+	routedRow := make(map[string]interface{}, len(row)+len(cells))
+	for key, value := range row {
+		routedRow[key] = value
+	}
+	for key, value := range cells {
+		routedRow[key] = value
+	}
+	routedRow[routedByKey] = routedBy
+	if !target.Filter.allows(chunkName, routedRow) {
+		log.Printf("Row #%d routed to '%s', which filters it out\n", rowIndex, chunkName)
+		return
+	}
+
+	log.Printf("Row #%d routed from '%s' to '%s' (%s: %v)\n", rowIndex, gptSettings.Name, chunkName, gptSettings.Route.Column, value)
+	// Wait for a free slot in another goroutine: this job holds one until it returns
+	go runGptSettingsOnRowWithSemaphore(routedRow, target)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// maxCellLength is the maximum number of characters Google Sheets accepts in a single cell.
+const maxCellLength = 50000
+
+// Output sanitization modes. "escape" prefixes values that would be parsed as a formula with an apostrophe,
+// "raw" writes the chunk's values with the RAW input option, and "off" writes values as the user would type them.
+const (
+	sanitizeEscape = "escape"
+	sanitizeRaw    = "raw"
+	sanitizeOff    = "off"
+)
+
+// overflowTabHeader is written to a newly created overflow tab.
+var overflowTabHeader = []interface{}{"Chunk", "Column", "Row", "Part", "Value"}
+
+var sanitizedWrites int
+var splitWrites int
+
+// OutputSafety holds how a chunk's output is made safe to write to the sheet.
+type OutputSafety struct {
+	Mode            string
+	OverflowColumns []string
+	OverflowTab     string
+}
+
+// parseSanitizeMode validates an OUTPUT_SANITIZE value.
+// It returns an error if the value is not one of the known modes.
+func parseSanitizeMode(value string) (string, error) {
+	mode := strings.ToLower(strings.TrimSpace(value))
+	switch mode {
+	case sanitizeEscape, sanitizeRaw, sanitizeOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("error: OUTPUT_SANITIZE must be escape, raw or off. It is %s", value)
+}
+
+// sanitizeMode returns the chunk's sanitization mode, falling back to the global OUTPUT_SANITIZE setting
+// and then to escaping.
+func (s OutputSafety) sanitizeMode() string {
+	if s.Mode != "" {
+		return s.Mode
+	}
+	if mode, ok := allSettings["GLOBAL"]["OUTPUT_SANITIZE"].(string); ok {
+		if mode, err := parseSanitizeMode(mode); err == nil {
+			return mode
+		}
+	}
+	return sanitizeEscape
+}
+
+// valueInputOption returns the Sheets value input option used for the chunk's writes.
+func (s OutputSafety) valueInputOption() string {
+	if s.sanitizeMode() == sanitizeRaw {
+		return "RAW"
+	}
+	return "USER_ENTERED"
+}
+
+// escapeFormula prefixes a value with an apostrophe if Sheets would otherwise interpret it as a formula.
+// It returns the escaped value and whether it was changed.
+func escapeFormula(value string) (string, bool) {
+	if value == "" {
+		return value, false
+	}
+	switch value[0] {
+	case '=', '+', '-', '@', '\t', '\r':
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return value, false
+		}
+		return "'" + value, true
+	}
+	return value, false
+}
+
+// splitCellValue splits a value into parts that each fit in one cell, leaving room for an escape character.
+func splitCellValue(value string) []string {
+	runes := []rune(value)
+	size := maxCellLength - 1
+	var parts []string
+	for len(runes) > size {
+		parts = append(parts, string(runes[:size]))
+		runes = runes[size:]
+	}
+	return append(parts, string(runes))
+}
+
+// prepareCellWrites builds the value ranges that write a chunk's output values to a row.
+// Values longer than a cell can hold are spread over the chunk's overflow columns, appended to its overflow tab
+// with a pointer left in the cell, or truncated when neither is configured.
+// Values are escaped according to the chunk's sanitization mode.
+// It returns the value ranges to write, the unescaped value of every written cell keyed by column name,
+// and an error if the overflow tab could not be written.
+func prepareCellWrites(gptSettings ChunkSettings, rowIndex int, columns []string, values []interface{}) ([]*sheets.ValueRange, map[string]interface{}, error) {
+	safety := gptSettings.Safety
+	mode := safety.sanitizeMode()
+
+	cells := make(map[string]interface{})
+	var order []string
+	setCell := func(columnName string, value interface{}) {
+		if _, ok := cells[columnName]; !ok {
+			order = append(order, columnName)
+		}
+		cells[columnName] = value
+	}
+
+	for i, value := range values {
+		columnName := columns[i]
+		output, ok := value.(string)
+		if !ok {
+			setCell(columnName, value)
+			continue
+		}
+
+		parts := splitCellValue(output)
+		if len(parts) > 1 {
+			splitWrites++
+			recordStat("Split Writes", splitWrites)
+		}
+
+		switch {
+		case len(parts) > 1 && columnName == gptSettings.PromptColTo && len(safety.OverflowColumns) > 0:
+			if len(parts) > len(safety.OverflowColumns)+1 {
+				log.Printf("Row #%d output for '%s' needs %d cells, only %d overflow columns are configured; truncating", rowIndex, gptSettings.Name, len(parts), len(safety.OverflowColumns))
+				parts = parts[:len(safety.OverflowColumns)+1]
+			}
+			setCell(columnName, parts[0])
+			for j, overflowColumn := range safety.OverflowColumns {
+				if j+1 < len(parts) {
+					setCell(overflowColumn, parts[j+1])
+				} else {
+					setCell(overflowColumn, "")
+				}
+			}
+			continue
+		case len(parts) > 1 && safety.OverflowTab != "":
+			if _, err := ensureSheet(safety.OverflowTab, overflowTabHeader); err != nil {
+				return nil, nil, err
+			}
+			rows := make([][]interface{}, len(parts))
+			for j, part := range parts {
+				rows[j] = []interface{}{gptSettings.Name, columnName, rowIndex + 1, j + 1, part}
+			}
+			resp, err := appendToSheetWithRateLimit(safety.OverflowTab, rows)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to write overflow tab %s: %v", safety.OverflowTab, err)
+			}
+			marker := fmt.Sprintf(" … [continued in %s]", resp.Updates.UpdatedRange)
+			head := []rune(parts[0])
+			output = string(head[:maxCellLength-1-len([]rune(marker))]) + marker
+		case len(parts) > 1:
+			log.Printf("Row #%d output for '%s' is longer than %d characters; truncating", rowIndex, gptSettings.Name, maxCellLength)
+			output = parts[0]
+		default:
+			if columnName == gptSettings.PromptColTo {
+				// Clear overflow left behind by a previous long answer
+				for _, overflowColumn := range safety.OverflowColumns {
+					setCell(overflowColumn, "")
+				}
+			}
+		}
+		setCell(columnName, output)
+	}
+
+	data := make([]*sheets.ValueRange, 0, len(order))
+	for _, columnName := range order {
+		value := cells[columnName]
+		if output, ok := value.(string); ok && mode == sanitizeEscape {
+			if escaped, changed := escapeFormula(output); changed {
+				value = escaped
+				sanitizedWrites++
+				recordStat("Sanitized Writes", sanitizedWrites)
+			}
+		}
+		data = append(data, &sheets.ValueRange{
+			Range:  fmt.Sprintf("%v%d", columnLetterByName[columnName], rowIndex+1),
+			Values: [][]interface{}{{value}},
+		})
+	}
+
+	return data, cells, nil
+}
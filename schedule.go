@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ActiveHours is a set of daily time windows in a timezone during which a chunk may run.
+type ActiveHours struct {
+	Windows  [][2]int // minutes since midnight, start inclusive and end exclusive
+	Location *time.Location
+}
+
+// parseActiveHours parses a value such as "22:00-06:00 Europe/Berlin" or "09:00-12:00,13:00-17:00".
+// Windows may wrap around midnight and may have spaces around the dash. Without a timezone the global TIMEZONE
+// setting, or UTC, is used.
+// It returns an error if a window or the timezone is invalid.
+func parseActiveHours(value string) (*ActiveHours, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	hours := &ActiveHours{}
+	if last := fields[len(fields)-1]; len(fields) > 1 && strings.IndexFunc(last, unicode.IsLetter) >= 0 {
+		location, err := time.LoadLocation(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("error: unknown timezone %s", fields[len(fields)-1])
+		}
+		hours.Location = location
+		fields = fields[:len(fields)-1]
+	}
+
+	for _, window := range strings.Split(strings.Join(fields, ""), ",") {
+		if window == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(strings.TrimSpace(window), "-")
+		if !ok {
+			return nil, fmt.Errorf("error: active hours window %s is not HH:MM-HH:MM", window)
+		}
+		startMinute, err := parseClock(start)
+		if err != nil {
+			return nil, err
+		}
+		endMinute, err := parseClock(end)
+		if err != nil {
+			return nil, err
+		}
+		hours.Windows = append(hours.Windows, [2]int{startMinute, endMinute})
+	}
+
+	return hours, nil
+}
+
+// parseClock parses HH:MM or HH into minutes since midnight. 24:00 is accepted as the end of the day.
+func parseClock(value string) (int, error) {
+	hour, minute, _ := strings.Cut(strings.TrimSpace(value), ":")
+	h, err := strconv.Atoi(hour)
+	if err != nil || h < 0 || (h > 23 && !(h == 24 && strings.Trim(minute, "0") == "")) {
+		return 0, fmt.Errorf("error: %s is not a time of day", value)
+	}
+	m := 0
+	if minute != "" {
+		m, err = strconv.Atoi(minute)
+		if err != nil || m < 0 || m > 59 {
+			return 0, fmt.Errorf("error: %s is not a time of day", value)
+		}
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether a time falls inside one of the windows.
+func (a *ActiveHours) contains(t time.Time) bool {
+	location := a.Location
+	if location == nil {
+		location = settingsLocation()
+	}
+	local := t.In(location)
+	minute := local.Hour()*60 + local.Minute()
+
+	for _, window := range a.Windows {
+		start, end := window[0], window[1]
+		if start <= end && minute >= start && minute < end {
+			return true
+		}
+		if start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsLocation returns the location of the global TIMEZONE setting, or UTC if it is not set or unknown.
+func settingsLocation() *time.Location {
+	if name, ok := allSettings["GLOBAL"]["TIMEZONE"].(string); ok {
+		if location, err := time.LoadLocation(strings.TrimSpace(name)); err == nil {
+			return location
+		}
+	}
+	return time.UTC
+}
+
+// globalPaused reports whether the engine is paused by a PAUSE command or the PAUSED setting.
+func globalPaused() bool {
+	paused, _ := allSettings["GLOBAL"]["PAUSED"].(bool)
+	return enginePaused || paused
+}
+
+// isActive reports whether the chunk may run now: it is enabled and inside its ACTIVE_HOURS,
+// or the global ACTIVE_HOURS when it has none.
+func (c ChunkSettings) isActive(now time.Time) bool {
+	if c.Disabled {
+		return false
+	}
+	hours := c.ActiveHours
+	if hours == nil {
+		hours, _ = allSettings["GLOBAL"]["ACTIVE_HOURS"].(*ActiveHours)
+	}
+	return hours == nil || hours.contains(now)
+}
+
+// queuedKey returns the Redis key of the set of rows whose trigger fired while the chunk was inactive.
+func queuedKey(chunkName string) string {
+	return fmt.Sprintf("queued:%s", chunkName)
+}
+
+// queueTrigger remembers that a chunk was triggered on a row while it was inactive, so it runs once it is active.
+func queueTrigger(chunkName string, rowIndex int) {
+	if err := redisClient.SAdd(queuedKey(chunkName), rowIndex).Err(); err != nil {
+		log.Printf("Error adding value in Redis: %v", err)
+	}
+}
+
+// loadQueuedTriggers returns the rows queued for every active chunk, keyed by chunk name.
+func loadQueuedTriggers(now time.Time) map[string]map[int]bool {
+	queued := make(map[string]map[int]bool)
+	for name, gptSettings := range gptSettingsByName {
+		if !gptSettings.isActive(now) {
+			continue
+		}
+		members, err := redisClient.SMembers(queuedKey(name)).Result()
+		if err != nil {
+			log.Printf("Error getting value from Redis: %v", err)
+			continue
+		}
+		for _, member := range members {
+			rowIndex, err := strconv.Atoi(member)
+			if err != nil {
+				continue
+			}
+			if queued[name] == nil {
+				queued[name] = make(map[int]bool)
+			}
+			queued[name][rowIndex] = true
+		}
+	}
+	return queued
+}
+
+// dequeueTrigger removes a row from a chunk's queue once it has been dispatched.
+func dequeueTrigger(chunkName string, rowIndex int) {
+	if err := redisClient.SRem(queuedKey(chunkName), rowIndex).Err(); err != nil {
+		log.Printf("Error removing value in Redis: %v", err)
+	}
+}
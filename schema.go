@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultOutputRetries is how many times a chunk re-asks the model after an invalid response
+// when OUTPUT_RETRIES is not set.
+const defaultOutputRetries = 1
+
+// invalidDestinations holds the chunks with a destination column missing from the sheet header.
+// They are not dispatched, since every write to the missing column would fail.
+var invalidDestinations = make(map[string]bool)
+
+// structuredOutputFunctionName is the name of the function the model is forced to call
+// when a chunk declares an output schema.
+const structuredOutputFunctionName = "write_columns"
+
+// OutputSchema describes a structured response whose fields are written to several columns.
+// Each property name is the name of the destination column in the watched sheet.
+type OutputSchema struct {
+	Columns    []string
+	Types      map[string]string
+	Required   []string
+	Parameters json.RawMessage
+}
+
+// parseOutputSchema parses a VARx_OUTPUT_SCHEMA value. The value is either a JSON Schema
+// object whose properties are the destination columns, or a comma separated list of column names,
+// in which case every column is a required string.
+// It returns an error if the value cannot be parsed.
+func parseOutputSchema(value string) (*OutputSchema, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("output schema is empty")
+	}
+
+	schema := &OutputSchema{Types: make(map[string]string)}
+
+	if !strings.HasPrefix(value, "{") {
+		properties := make(map[string]interface{})
+		for _, column := range strings.Split(value, ",") {
+			column = strings.TrimSpace(column)
+			if column == "" {
+				continue
+			}
+			schema.Columns = append(schema.Columns, column)
+			schema.Types[column] = "string"
+			properties[column] = map[string]interface{}{"type": "string"}
+		}
+		if len(schema.Columns) == 0 {
+			return nil, fmt.Errorf("output schema has no columns")
+		}
+		schema.Required = schema.Columns
+
+		parameters, err := json.Marshal(map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   schema.Required,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode output schema: %v", err)
+		}
+		schema.Parameters = parameters
+		return schema, nil
+	}
+
+	var jsonSchema struct {
+		Type       string                     `json:"type"`
+		Properties map[string]json.RawMessage `json:"properties"`
+		Required   []string                   `json:"required"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	if err := decoder.Decode(&jsonSchema); err != nil {
+		return nil, fmt.Errorf("output schema is not valid JSON: %v", err)
+	}
+	if jsonSchema.Type != "" && jsonSchema.Type != "object" {
+		return nil, fmt.Errorf("output schema must be of type object, not %s", jsonSchema.Type)
+	}
+	if len(jsonSchema.Properties) == 0 {
+		return nil, fmt.Errorf("output schema has no properties")
+	}
+
+	// Keep the columns in the order they are declared in the schema
+	decoder = json.NewDecoder(strings.NewReader(value))
+	order, err := propertyOrder(decoder)
+	if err != nil {
+		return nil, fmt.Errorf("output schema is not valid JSON: %v", err)
+	}
+	for _, column := range order {
+		var property struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(jsonSchema.Properties[column], &property); err != nil {
+			return nil, fmt.Errorf("output schema property %q is not valid: %v", column, err)
+		}
+		schema.Columns = append(schema.Columns, column)
+		schema.Types[column] = property.Type
+	}
+	for _, column := range jsonSchema.Required {
+		if _, ok := schema.Types[column]; !ok {
+			return nil, fmt.Errorf("output schema requires unknown property %q", column)
+		}
+	}
+	schema.Required = jsonSchema.Required
+	schema.Parameters = json.RawMessage(value)
+
+	return schema, nil
+}
+
+// propertyOrder returns the keys of the top-level "properties" object in the order they appear.
+func propertyOrder(decoder *json.Decoder) ([]string, error) {
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, _ := token.(string); key != "properties" {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var order []string
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			order = append(order, token.(string))
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+		return order, nil
+	}
+	return nil, fmt.Errorf("no properties found")
+}
+
+// functionDefinition returns the function the model is asked to call with the structured output.
+func (s *OutputSchema) functionDefinition() openai.FunctionDefinition {
+	return openai.FunctionDefinition{
+		Name:        structuredOutputFunctionName,
+		Description: "Write the answer to the destination columns of the spreadsheet row.",
+		Parameters:  s.Parameters,
+	}
+}
+
+// parseResponse extracts the structured output from a response message and validates it against the schema.
+// The model may either call the function or, if it ignores the instruction, answer with plain JSON.
+// It returns the cell values in column order, or an error describing why the response is invalid.
+func (s *OutputSchema) parseResponse(message openai.ChatCompletionMessage) ([]interface{}, error) {
+	arguments := message.Content
+	if message.FunctionCall != nil {
+		arguments = message.FunctionCall.Arguments
+	}
+	arguments = strings.TrimSpace(arguments)
+	arguments = strings.TrimPrefix(arguments, "```json")
+	arguments = strings.TrimPrefix(arguments, "```")
+	arguments = strings.TrimSuffix(arguments, "```")
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &fields); err != nil {
+		return nil, fmt.Errorf("response is not a JSON object: %v", err)
+	}
+
+	for _, column := range s.Required {
+		if value, ok := fields[column]; !ok || value == nil {
+			return nil, fmt.Errorf("response is missing required field %q", column)
+		}
+	}
+
+	values := make([]interface{}, len(s.Columns))
+	for i, column := range s.Columns {
+		value, ok := fields[column]
+		if !ok || value == nil {
+			values[i] = ""
+			continue
+		}
+		if err := checkSchemaType(s.Types[column], value); err != nil {
+			return nil, fmt.Errorf("field %q %v", column, err)
+		}
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("field %q cannot be encoded: %v", column, err)
+			}
+			values[i] = string(b)
+		default:
+			values[i] = v
+		}
+	}
+
+	return values, nil
+}
+
+// checkSchemaType checks that a decoded JSON value matches a JSON Schema type name.
+// An empty type name accepts any value.
+func checkSchemaType(schemaType string, value interface{}) error {
+	ok := true
+	switch schemaType {
+	case "string":
+		_, ok = value.(string)
+	case "number":
+		_, ok = value.(float64)
+	case "integer":
+		f, isNumber := value.(float64)
+		ok = isNumber && f == float64(int64(f))
+	case "boolean":
+		_, ok = value.(bool)
+	case "array":
+		_, ok = value.([]interface{})
+	case "object":
+		_, ok = value.(map[string]interface{})
+	}
+	if !ok {
+		return fmt.Errorf("must be of type %s, got %T", schemaType, value)
+	}
+	return nil
+}
+
+// missingDestinationColumns returns the chunk's destination and shadow columns that are not in the sheet header.
+// Chunks that write outside their row have none.
+func (c ChunkSettings) missingDestinationColumns() []string {
+	if c.Mode != "" || c.isTable() {
+		return nil
+	}
+	columns := c.destinationColumns()
+	if c.ShadowColumn != "" {
+		columns = append(append([]string{}, columns...), c.ShadowColumn)
+	}
+	var missing []string
+	for _, columnName := range columns {
+		if _, ok := columnIndexByName[columnName]; columnName != "" && !ok {
+			missing = append(missing, columnName)
+		}
+	}
+	return missing
+}
+
+// validateDestinations checks every chunk's destination columns against the sheet header, once it is known,
+// and logs the chunks that cannot be written.
+func validateDestinations() {
+	invalid := make(map[string]bool)
+	if len(columnIndexByName) > 0 {
+		for name, gptSettings := range gptSettingsByName {
+			if missing := gptSettings.missingDestinationColumns(); len(missing) > 0 {
+				log.Printf("Error: destination column(s) %s of '%s' are not in the sheet header, skipping it", strings.Join(missing, ", "), name)
+				invalid[name] = true
+			}
+		}
+	}
+	invalidDestinations = invalid
+}
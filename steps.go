@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Values of VARx_STEPS_OUTPUT: write only the final step to PROMPT_COL_TO, or also every step to its STEP_<NAME>_COL.
+const (
+	stepsOutputFinal = "final"
+	stepsOutputEvery = "every"
+)
+
+// ChunkStep is one step of a chunk's STEPS, configured with VARx_STEP_<NAME>_* settings.
+type ChunkStep struct {
+	Name          string
+	SystemMessage string
+	UserMessage   string
+	StopOn        string
+	Column        string
+}
+
+// stepSettingSuffixes are the properties a VARx_STEP_<NAME>_ setting can set.
+var stepSettingSuffixes = []string{"_SYSTEM_MESSAGE", "_USER_MESSAGE", "_STOP_ON", "_COL"}
+
+// parseStepSetting applies a VARx_STEPS, VARx_STEPS_OUTPUT or VARx_STEP_<NAME>_* setting.
+// It returns true if the property is a steps setting, and an error if its value is invalid.
+func parseStepSetting(c *ChunkSettings, varProp string, varValue string) (bool, error) {
+	switch {
+	case varProp == "STEPS":
+		c.Steps = nil
+		for _, name := range strings.Split(varValue, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				c.Steps = append(c.Steps, name)
+			}
+		}
+		return true, nil
+	case varProp == "STEPS_OUTPUT":
+		output := strings.ToLower(strings.TrimSpace(varValue))
+		if output != stepsOutputFinal && output != stepsOutputEvery {
+			return true, fmt.Errorf("error: STEPS_OUTPUT must be final or every. It is %s", varValue)
+		}
+		c.StepsOutput = output
+		return true, nil
+	case strings.HasPrefix(varProp, "STEP_"):
+		for _, suffix := range stepSettingSuffixes {
+			if !strings.HasSuffix(varProp, suffix) || len(varProp) <= len("STEP_")+len(suffix) {
+				continue
+			}
+			name := strings.ToUpper(varProp[len("STEP_") : len(varProp)-len(suffix)])
+			if c.StepDefinitions == nil {
+				c.StepDefinitions = make(map[string]ChunkStep)
+			}
+			step := c.StepDefinitions[name]
+			switch suffix {
+			case "_SYSTEM_MESSAGE":
+				step.SystemMessage = varValue
+			case "_USER_MESSAGE":
+				step.UserMessage = varValue
+			case "_STOP_ON":
+				step.StopOn = strings.TrimSpace(varValue)
+			case "_COL":
+				step.Column = strings.TrimSpace(varValue)
+			}
+			c.StepDefinitions[name] = step
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// steps returns the chunk's steps in STEPS order. A step without a system or user message uses the chunk's.
+func (c ChunkSettings) steps() []ChunkStep {
+	steps := make([]ChunkStep, len(c.Steps))
+	for i, name := range c.Steps {
+		step := c.StepDefinitions[strings.ToUpper(name)]
+		step.Name = name
+		if step.SystemMessage == "" {
+			step.SystemMessage = c.SystemMessage
+		}
+		if step.UserMessage == "" {
+			step.UserMessage = c.UserMessage
+		}
+		steps[i] = step
+	}
+	return steps
+}
+
+// stopped reports whether a step's output is its STOP_ON answer, such as "OK".
+func (s ChunkStep) stopped(output string) bool {
+	if s.StopOn == "" {
+		return false
+	}
+	answer := strings.ToUpper(strings.TrimSpace(output))
+	stopOn := strings.ToUpper(s.StopOn)
+	return answer == stopOn || strings.HasPrefix(answer, stopOn+".") || strings.HasPrefix(answer, stopOn+"\n") || strings.HasPrefix(answer, stopOn+" ")
+}
+
+// stepsResult holds the outcome of a chunk's steps.
+type stepsResult struct {
+	completionResult
+	Request       openai.ChatCompletionRequest
+	SystemMessage string
+	UserMessage   string
+	Outputs       map[string]string
+}
+
+// runSteps runs a chunk's STEPS in order on a row. Every step sees the outputs of earlier steps as {STEP:<name>}
+// tokens and the previous step's output as {PREVIOUS}. Earlier steps answer in plain text; the last step is
+// validated like a single-step chunk. When a step's output matches its STOP_ON the steps stop and the output of the
+// step before it is the final value, validated against the chunk's output schema, post-processors and guardrails
+// like the last step's would have been.
+// It returns the final values in destination column order with the tokens used by every step, the request and
+// rendered messages of the step that produced them, and every step's output; or the error of the step that failed,
+// a *validationError if the final value is invalid.
+func runSteps(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings) (*stepsResult, error) {
+	stepRow := make(map[string]interface{}, len(row)+len(gptSettings.Steps)+1)
+	for key, value := range row {
+		stepRow[key] = value
+	}
+
+	result := &stepsResult{Outputs: make(map[string]string)}
+	steps := gptSettings.steps()
+	previous := ""
+	stopped := false
+	for i, step := range steps {
+		stepSettings := gptSettings
+		stepSettings.Name = fmt.Sprintf("%s/%s", gptSettings.Name, step.Name)
+		stepSettings.SystemMessage = step.SystemMessage
+		stepSettings.UserMessage = step.UserMessage
+		last := i == len(steps)-1
+		if !last {
+			stepSettings.OutputSchema = nil
+			stepSettings.Guardrails = OutputGuardrails{}
+			stepSettings.PostProcess = nil
+			stepSettings.Examples = ExampleSettings{}
+		}
+
+		systemMessage := renderTemplate(step.SystemMessage, stepRow)
+		userMessage := renderTemplate(step.UserMessage, stepRow)
+		request := newChatRequest(stepSettings, stepRow, systemMessage, userMessage)
+		stepResult, err := requestCompletion(stepSettings, request, fmt.Sprintf("Row #%d step '%s'", rowIndex, step.Name))
+		if stepResult != nil {
+			result.Usage.PromptTokens += stepResult.Usage.PromptTokens
+			result.Usage.CompletionTokens += stepResult.Usage.CompletionTokens
+			result.Usage.TotalTokens += stepResult.Usage.TotalTokens
+			result.Latency += stepResult.Latency
+			result.Model = stepResult.Model
+			result.ToolCalls = append(result.ToolCalls, stepResult.ToolCalls...)
+		}
+		if err != nil {
+			result.Request, result.SystemMessage, result.UserMessage = request, systemMessage, userMessage
+			return result, err
+		}
+
+		output := fmt.Sprint(stepResult.Values[stepSettings.guardedIndex()])
+		if step.stopped(output) && i > 0 {
+			log.Printf("Row #%d step '%s' of '%s' answered %s, stopping\n", rowIndex, step.Name, gptSettings.Name, step.StopOn)
+			result.Outputs[step.Name] = output
+			stopped = true
+			break
+		}
+
+		result.Outputs[step.Name] = output
+		stepRow["STEP:"+step.Name] = output
+		stepRow["PREVIOUS"] = output
+		previous = output
+		result.Request, result.SystemMessage, result.UserMessage = request, systemMessage, userMessage
+		result.Values = stepResult.Values
+	}
+
+	// Stopped before the last step: the final value is the last answer that was not a stop
+	if stopped {
+		values, err := gptSettings.validateMessage(openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: previous})
+		if err != nil {
+			log.Printf("Row #%d final value of '%s' failed validation: %v", rowIndex, gptSettings.Name, err)
+			result.Values = nil
+			return result, &validationError{Attempts: 1, Err: err}
+		}
+		result.Values = values
+	}
+	return result, nil
+}
+
+// stepColumns returns the columns and values of the steps whose output is written besides the final value,
+// when STEPS_OUTPUT is every.
+func (c ChunkSettings) stepColumns(result *stepsResult) ([]string, []interface{}) {
+	if c.StepsOutput != stepsOutputEvery {
+		return nil, nil
+	}
+	var columns []string
+	var values []interface{}
+	for _, step := range c.steps() {
+		output, ok := result.Outputs[step.Name]
+		if !ok || step.Column == "" {
+			continue
+		}
+		if _, ok := columnLetterByName[step.Column]; !ok {
+			log.Printf("Error: STEP_%s_COL column '%s' of '%s' does not exist", strings.ToUpper(step.Name), step.Column, c.Name)
+			continue
+		}
+		columns = append(columns, step.Column)
+		values = append(values, output)
+	}
+	return columns, values
+}
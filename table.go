@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"google.golang.org/api/sheets/v4"
+)
+
+// outputRangeModeTable is the VARx_OUTPUT_RANGE_MODE of chunks whose response is a table written as a 2-D block.
+const outputRangeModeTable = "TABLE"
+
+// isTable reports whether the chunk writes its response as a table.
+func (c ChunkSettings) isTable() bool {
+	return c.OutputRangeMode == outputRangeModeTable
+}
+
+// parseTable parses a table returned by the model. It accepts a JSON array of arrays or of objects,
+// a markdown pipe table, and CSV or tab separated lines.
+// It returns the table rows, or an error if the response is not a table.
+func parseTable(output string) ([][]interface{}, error) {
+	trimmed := strings.TrimSpace(output)
+	if match := markdownFencePattern.FindStringSubmatch(trimmed); match != nil {
+		trimmed = strings.TrimSpace(match[1])
+	}
+	if trimmed == "" {
+		return nil, fmt.Errorf("the answer is empty")
+	}
+
+	if strings.HasPrefix(trimmed, "[") {
+		return parseJSONTable(trimmed)
+	}
+
+	lines := strings.Split(trimmed, "\n")
+	if strings.HasPrefix(strings.TrimSpace(lines[0]), "|") {
+		var table [][]interface{}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "|") {
+				continue
+			}
+			line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+			cells := strings.Split(line, "|")
+			separator := true
+			row := make([]interface{}, len(cells))
+			for i, cell := range cells {
+				cell = strings.TrimSpace(cell)
+				if strings.Trim(cell, ":-") != "" || cell == "" {
+					separator = false
+				}
+				row[i] = cell
+			}
+			if !separator {
+				table = append(table, row)
+			}
+		}
+		return table, nil
+	}
+
+	reader := csv.NewReader(strings.NewReader(trimmed))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if strings.Contains(lines[0], "\t") {
+		reader.Comma = '\t'
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("the answer is not a table: %v", err)
+	}
+	table := make([][]interface{}, len(records))
+	for i, record := range records {
+		table[i] = make([]interface{}, len(record))
+		for j, cell := range record {
+			table[i][j] = strings.TrimSpace(cell)
+		}
+	}
+	return table, nil
+}
+
+// parseJSONTable parses a JSON array of arrays, or an array of objects whose keys, in the order of the first object,
+// become the header row.
+func parseJSONTable(value string) ([][]interface{}, error) {
+	var arrays [][]interface{}
+	if err := json.Unmarshal([]byte(value), &arrays); err == nil {
+		return arrays, nil
+	}
+
+	var objects []json.RawMessage
+	if err := json.Unmarshal([]byte(value), &objects); err != nil {
+		return nil, fmt.Errorf("the answer is not a JSON table: %v", err)
+	}
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(objects[0])))
+	var header []string
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("the answer is not a JSON table: %v", err)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("the answer is not a JSON table: %v", err)
+		}
+		header = append(header, token.(string))
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return nil, fmt.Errorf("the answer is not a JSON table: %v", err)
+		}
+	}
+
+	table := [][]interface{}{make([]interface{}, len(header))}
+	for i, name := range header {
+		table[0][i] = name
+	}
+	for _, raw := range objects {
+		var object map[string]interface{}
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, fmt.Errorf("the answer is not a JSON table: %v", err)
+		}
+		row := make([]interface{}, len(header))
+		for i, name := range header {
+			switch v := object[name].(type) {
+			case nil:
+				row[i] = ""
+			case map[string]interface{}, []interface{}:
+				b, _ := json.Marshal(v)
+				row[i] = string(b)
+			default:
+				row[i] = v
+			}
+		}
+		table = append(table, row)
+	}
+	return table, nil
+}
+
+// parseA1Cell splits a single-cell A1 reference such as "Tables!B2" into the sheet title,
+// the zero-based column index and the one-based row number.
+// It returns an error if the reference is not a single cell.
+func parseA1Cell(reference string) (string, int, int, error) {
+	title := ""
+	cell := reference
+	if i := strings.LastIndex(reference, "!"); i >= 0 {
+		title = sheetTitle(reference)
+		cell = reference[i+1:]
+	}
+	cell = strings.ToUpper(strings.TrimSpace(cell))
+
+	letters := strings.TrimRight(cell, "0123456789")
+	digits := cell[len(letters):]
+	if letters == "" || digits == "" {
+		return "", 0, 0, fmt.Errorf("%q is not a cell reference", reference)
+	}
+	rowNumber, err := strconv.Atoi(digits)
+	if err != nil || rowNumber < 1 {
+		return "", 0, 0, fmt.Errorf("%q is not a cell reference", reference)
+	}
+
+	columnNumber := 0
+	for _, r := range letters {
+		if r < 'A' || r > 'Z' {
+			return "", 0, 0, fmt.Errorf("%q is not a cell reference", reference)
+		}
+		columnNumber = columnNumber*26 + int(r-'A'+1)
+	}
+	return title, columnNumber - 1, rowNumber, nil
+}
+
+// tableRange returns the A1 range of a block of the given size anchored at a cell.
+func tableRange(title string, column int, rowNumber int, rows int, columns int) string {
+	return fmt.Sprintf("'%s'!%s%d:%s%d", title, getExcelColumnName(column+1), rowNumber, getExcelColumnName(column+columns), rowNumber+rows-1)
+}
+
+// runTableOnRow runs a TABLE chunk on a row. The response is parsed as a table and written as a block anchored at
+// TABLE_ANCHOR, or at A1 of OUTPUT_TAB. Both are rendered with the row's tokens so each row can get its own tab.
+// The size of the last table written at the anchor is kept in Redis and any part the new table no longer covers
+// is cleared.
+// It returns an error if an error occurred.
+func runTableOnRow(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings) error {
+	title := renderTemplate(gptSettings.OutputTab, row)
+	column, rowNumber := 0, 1
+	if gptSettings.TableAnchor != "" {
+		anchorTitle, anchorColumn, anchorRow, err := parseA1Cell(renderTemplate(gptSettings.TableAnchor, row))
+		if err != nil {
+			return fmt.Errorf("TABLE_ANCHOR of %s is invalid: %v", gptSettings.Name, err)
+		}
+		if anchorTitle == "" {
+			anchorTitle = sheetTitle(allSettings["GLOBAL"]["SHEET_NAME"].(string))
+		}
+		title, column, rowNumber = anchorTitle, anchorColumn, anchorRow
+	}
+
+	systemMessage := renderTemplate(gptSettings.SystemMessage, row)
+	userMessage := renderTemplate(gptSettings.UserMessage, row)
+	request := newChatRequest(gptSettings, row, systemMessage, userMessage)
+
+	result, err := requestCompletion(gptSettings, request, fmt.Sprintf("Row #%d", rowIndex))
+	if err != nil {
+		return err
+	}
+
+	table, err := parseTable(fmt.Sprint(result.Values[gptSettings.guardedIndex()]))
+	if err != nil {
+		return fmt.Errorf("row #%d response for '%s' is not a table: %v", rowIndex, gptSettings.Name, err)
+	}
+	width := 0
+	for _, tableRow := range table {
+		if len(tableRow) > width {
+			width = len(tableRow)
+		}
+	}
+
+	mode := gptSettings.Safety.sanitizeMode()
+	for i, tableRow := range table {
+		for len(tableRow) < width {
+			tableRow = append(tableRow, "")
+		}
+		for j, cell := range tableRow {
+			if s, ok := cell.(string); ok && mode == sanitizeEscape {
+				tableRow[j], _ = escapeFormula(s)
+			}
+		}
+		table[i] = tableRow
+	}
+
+	defer lockTab(title)()
+
+	if _, err := ensureSheet(title, nil); err != nil {
+		return err
+	}
+
+	// Clear the previous table if the new one doesn't cover it
+	sizeKey := fmt.Sprintf("table:%s!%d:%d", title, column, rowNumber)
+	if previous, err := redisClient.Get(sizeKey).Result(); err == nil {
+		var previousRows, previousColumns int
+		if _, err := fmt.Sscanf(previous, "%dx%d", &previousRows, &previousColumns); err == nil &&
+			(previousRows > len(table) || previousColumns > width) {
+			if err := clearRangeWithRateLimit(tableRange(title, column, rowNumber, previousRows, previousColumns)); err != nil {
+				return err
+			}
+		}
+	} else if err != redis.Nil {
+		log.Printf("Error getting value from Redis: %v", err)
+	}
+
+	if len(table) > 0 && width > 0 {
+		range_ := tableRange(title, column, rowNumber, len(table), width)
+		_, err = batchWriteToSheetWithRateLimit(spreadsheetID, []*sheets.ValueRange{{Range: range_, Values: table}}, gptSettings.Safety.valueInputOption())
+		if err != nil {
+			return fmt.Errorf("unable to write %s: %v", range_, err)
+		}
+		log.Printf("Wrote %dx%d table of row #%d to %s\n", len(table), width, rowIndex, range_)
+	}
+
+	if err := redisClient.Set(sizeKey, fmt.Sprintf("%dx%d", len(table), width), 0).Err(); err != nil {
+		log.Printf("Error setting value in Redis: %v", err)
+	}
+	rememberDefinition(rowIndex, gptSettings)
+	return nil
+}
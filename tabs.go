@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// tabMutexes serializes read-modify-write sequences on each tab the engine manages,
+// so two goroutines never claim the same row.
+var tabMutexes = make(map[string]*sync.Mutex)
+var tabMutexesMutex = &sync.Mutex{}
+
+// lockTab locks the mutex of a tab, creating it if needed. It returns the function that unlocks it.
+func lockTab(title string) func() {
+	tabMutexesMutex.Lock()
+	mutex, ok := tabMutexes[title]
+	if !ok {
+		mutex = &sync.Mutex{}
+		tabMutexes[title] = mutex
+	}
+	tabMutexesMutex.Unlock()
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// sheetTitle returns the sheet title part of an A1 range such as "Sheet1!A:Z".
+func sheetTitle(range_ string) string {
+	if i := strings.Index(range_, "!"); i >= 0 {
+		range_ = range_[:i]
+	}
+	return strings.Trim(range_, "'")
+}
+
+// sheetIDs caches the numeric ID of every sheet of the spreadsheet by title, so writing a row doesn't read
+// the whole spreadsheet. It is emptied every time the settings are read.
+var sheetIDs map[string]int64
+var sheetIDsMutex = &sync.Mutex{}
+
+// resetSheetIDs empties the sheet ID cache, so tabs added or removed by hand are seen.
+func resetSheetIDs() {
+	sheetIDsMutex.Lock()
+	sheetIDs = nil
+	sheetIDsMutex.Unlock()
+}
+
+// cachedSheetID looks up the numeric ID of a sheet by its title, reading the spreadsheet if the cache is empty.
+// It returns false if the spreadsheet has no sheet with that title, or an error if it could not be read.
+func cachedSheetID(title string) (int64, bool, error) {
+	sheetIDsMutex.Lock()
+	defer sheetIDsMutex.Unlock()
+	if sheetIDs == nil {
+		if err := sheetsLimiter.Wait(context.Background()); err != nil {
+			return 0, false, err
+		}
+		spreadsheet, err := srv.Spreadsheets.Get(spreadsheetID).Do()
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to retrieve spreadsheet: %v", err)
+		}
+		sheetIDs = make(map[string]int64)
+		for _, sheet := range spreadsheet.Sheets {
+			sheetIDs[sheet.Properties.Title] = sheet.Properties.SheetId
+		}
+	}
+	sheetID, ok := sheetIDs[title]
+	return sheetID, ok, nil
+}
+
+// getSheetID looks up the numeric ID of a sheet by its title.
+// It returns an error if the spreadsheet could not be read or has no sheet with that title.
+func getSheetID(title string) (int64, error) {
+	sheetID, ok, err := cachedSheetID(title)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("sheet %q not found", title)
+	}
+	return sheetID, nil
+}
+
+// ensureSheet creates a sheet with the given title if it doesn't already exist,
+// and writes the header row to a newly created sheet.
+// It returns the numeric ID of the sheet.
+func ensureSheet(title string, header []interface{}) (int64, error) {
+	if sheetID, ok, err := cachedSheetID(title); err != nil {
+		return 0, err
+	} else if ok {
+		return sheetID, nil
+	}
+
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return 0, err
+	}
+	resp, err := srv.Spreadsheets.BatchUpdate(spreadsheetID, &sheets.BatchUpdateSpreadsheetRequest{
+		Requests: []*sheets.Request{
+			{
+				AddSheet: &sheets.AddSheetRequest{
+					Properties: &sheets.SheetProperties{
+						Title: title,
+					},
+				},
+			},
+		},
+	}).Do()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s sheet: %v", title, err)
+	}
+	sheetID := resp.Replies[0].AddSheet.Properties.SheetId
+	sheetIDsMutex.Lock()
+	if sheetIDs != nil {
+		sheetIDs[title] = sheetID
+	}
+	sheetIDsMutex.Unlock()
+
+	if len(header) > 0 {
+		vr := &sheets.ValueRange{
+			Values: [][]interface{}{header},
+		}
+		_, err = writeToSheetWithRateLimit(spreadsheetID, fmt.Sprintf("'%s'!A1", title), vr)
+		if err != nil {
+			return 0, fmt.Errorf("failed to write %s header: %v", title, err)
+		}
+	}
+
+	return sheetID, nil
+}
+
+// appendToSheetWithRateLimit waits for a token from the rate limiter, then appends rows below the last row of a sheet.
+// It returns the response from the append operation and any error encountered.
+func appendToSheetWithRateLimit(title string, rows [][]interface{}) (*sheets.AppendValuesResponse, error) {
+	// Wait for a token from the rate limiter
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return nil, err
+	}
+
+	vr := &sheets.ValueRange{
+		Values: rows,
+	}
+	return srv.Spreadsheets.Values.Append(spreadsheetID, fmt.Sprintf("'%s'!A1", title), vr).
+		ValueInputOption("RAW").
+		InsertDataOption("INSERT_ROWS").
+		Do()
+}
+
+// clearRangeWithRateLimit waits for a token from the rate limiter, then clears the values of a range.
+// It returns an error if the range could not be cleared.
+func clearRangeWithRateLimit(range_ string) error {
+	// Wait for a token from the rate limiter
+	if err := sheetsLimiter.Wait(context.Background()); err != nil {
+		return err
+	}
+
+	_, err := srv.Spreadsheets.Values.Clear(spreadsheetID, range_, &sheets.ClearValuesRequest{}).Do()
+	if err != nil {
+		return fmt.Errorf("failed to clear %s: %v", range_, err)
+	}
+	return nil
+}
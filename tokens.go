@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// sheetRows holds the rows of the watched sheet from the latest poll, including the header row.
+// Aggregate tokens are evaluated against it.
+var sheetRows [][]interface{}
+
+// aggregateTokenPrefixes lists the tokens that are evaluated across rows rather than against the current row.
+var aggregateTokenPrefixes = []string{"{COLUMN:", "{ROW:", "{COUNT:", "{LOOKUP:", "{RANGE:"}
+
+// rowCondition is one Column=value or Column!=value condition of an aggregate token.
+type rowCondition struct {
+	Column string
+	Value  string
+	Negate bool
+}
+
+// renderTemplate renders a prompt template for a row.
+// Aggregate tokens such as {COLUMN:Feedback|where:Product={Product}|join:"\n"|limit:50}, {ROW:-1:Price}
+// and {COUNT:Status=open} are evaluated against the latest sheet snapshot, {LOOKUP:Catalog!SKU={SKU}:Description}
+// and {RANGE:Glossary!A:B} against the cached lookup tabs, and every other token is replaced
+// with the value of the current row.
+func renderTemplate(message string, row map[string]interface{}) string {
+	var rendered strings.Builder
+	for {
+		start, end := nextAggregateToken(message)
+		if start < 0 {
+			rendered.WriteString(replaceTokens(message, row))
+			return rendered.String()
+		}
+		rendered.WriteString(replaceTokens(message[:start], row))
+
+		token := message[start+1 : end]
+		value, err := evaluateAggregateToken(replaceTokens(token, row), row)
+		if err != nil {
+			log.Printf("Error evaluating token {%s}: %v", token, err)
+		}
+		rendered.WriteString(value)
+		message = message[end+1:]
+	}
+}
+
+// nextAggregateToken finds the first aggregate token in a message, allowing nested {Column} tokens
+// and quoted strings inside it. It returns the index of the opening and closing brace, or -1 if there is none.
+func nextAggregateToken(message string) (int, int) {
+	start := -1
+	for _, prefix := range aggregateTokenPrefixes {
+		if i := strings.Index(message, prefix); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	if start < 0 {
+		return -1, -1
+	}
+
+	depth := 0
+	inQuotes := false
+	for i := start; i < len(message); i++ {
+		switch message[i] {
+		case '\\':
+			if inQuotes {
+				i++
+			}
+		case '"':
+			inQuotes = !inQuotes
+		case '{':
+			if !inQuotes {
+				depth++
+			}
+		case '}':
+			if !inQuotes {
+				depth--
+				if depth == 0 {
+					return start, i
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// evaluateAggregateToken evaluates the body of an aggregate token, without its braces.
+// It returns the rendered value and an error if the token is malformed.
+func evaluateAggregateToken(token string, row map[string]interface{}) (string, error) {
+	kind, body, _ := strings.Cut(token, ":")
+	rowIndex, _ := row["RowIndex"].(int)
+
+	switch kind {
+	case "LOOKUP":
+		return evaluateLookupToken(body)
+
+	case "RANGE":
+		return evaluateRangeToken(body)
+
+	case "ROW":
+		offset, columnName, ok := strings.Cut(body, ":")
+		if !ok {
+			return "", fmt.Errorf("expected {ROW:<offset>:<column>}")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(offset))
+		if err != nil {
+			return "", fmt.Errorf("row offset %q is not an int", offset)
+		}
+		target := rowIndex + n
+		if target < 1 || target >= len(sheetRows) {
+			return "", nil
+		}
+		return snapshotValue(target, strings.TrimSpace(columnName)), nil
+
+	case "COUNT":
+		conditions, err := parseRowConditions(body)
+		if err != nil {
+			return "", err
+		}
+		count := 0
+		for i := 1; i < len(sheetRows); i++ {
+			if rowMatches(i, conditions) {
+				count++
+			}
+		}
+		return strconv.Itoa(count), nil
+
+	case "COLUMN":
+		options := strings.Split(body, "|")
+		columnName := strings.TrimSpace(options[0])
+		if _, ok := columnIndexByName[columnName]; !ok {
+			return "", fmt.Errorf("unknown column %q", columnName)
+		}
+
+		separator := "\n"
+		limit := 0
+		excludeSelf := false
+		var conditions []rowCondition
+		for _, option := range options[1:] {
+			name, value, _ := strings.Cut(option, ":")
+			switch strings.TrimSpace(name) {
+			case "where":
+				parsed, err := parseRowConditions(value)
+				if err != nil {
+					return "", err
+				}
+				conditions = append(conditions, parsed...)
+			case "join":
+				if unquoted, err := strconv.Unquote(strings.TrimSpace(value)); err == nil {
+					separator = unquoted
+				} else {
+					separator = value
+				}
+			case "limit":
+				n, err := strconv.Atoi(strings.TrimSpace(value))
+				if err != nil {
+					return "", fmt.Errorf("limit %q is not an int", value)
+				}
+				limit = n
+			case "exclude_self":
+				excludeSelf = true
+			default:
+				return "", fmt.Errorf("unknown option %q", name)
+			}
+		}
+
+		var values []string
+		for i := 1; i < len(sheetRows); i++ {
+			if excludeSelf && i == rowIndex {
+				continue
+			}
+			if !rowMatches(i, conditions) {
+				continue
+			}
+			value := snapshotValue(i, columnName)
+			if value == "" {
+				continue
+			}
+			values = append(values, value)
+			if limit > 0 && len(values) >= limit {
+				break
+			}
+		}
+		return strings.Join(values, separator), nil
+	}
+
+	return "", fmt.Errorf("unknown token kind %q", kind)
+}
+
+// parseRowConditions parses conditions such as "Status=open&Product!=Widget".
+// It returns an error if a condition has no operator.
+func parseRowConditions(value string) ([]rowCondition, error) {
+	var conditions []rowCondition
+	for _, part := range strings.Split(value, "&") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		var condition rowCondition
+		if column, expected, ok := strings.Cut(part, "!="); ok {
+			condition = rowCondition{Column: column, Value: expected, Negate: true}
+		} else if column, expected, ok := strings.Cut(part, "="); ok {
+			condition = rowCondition{Column: column, Value: expected}
+		} else {
+			return nil, fmt.Errorf("condition %q must be Column=value or Column!=value", part)
+		}
+		condition.Column = strings.TrimSpace(condition.Column)
+		condition.Value = strings.TrimSpace(condition.Value)
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// rowMatches reports whether a snapshot row satisfies every condition.
+func rowMatches(rowIndex int, conditions []rowCondition) bool {
+	for _, condition := range conditions {
+		equal := strings.EqualFold(snapshotValue(rowIndex, condition.Column), condition.Value)
+		if equal == condition.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotValue returns the value of a column in a snapshot row as a string, or "" if the cell is empty.
+func snapshotValue(rowIndex int, columnName string) string {
+	columnIndex, ok := columnIndexByName[columnName]
+	if !ok || rowIndex < 0 || rowIndex >= len(sheetRows) || columnIndex >= len(sheetRows[rowIndex]) {
+		return ""
+	}
+	return fmt.Sprint(sheetRows[rowIndex][columnIndex])
+}
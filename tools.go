@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Tools a chunk can enable with VARx_TOOLS. They run locally against the latest sheet snapshot and the lookup cache.
+const (
+	toolSearchRows = "search_rows"
+	toolGetRow     = "get_row"
+	toolLookupTab  = "lookup_tab"
+)
+
+// defaultToolMaxTurns is how many rounds of tool calls a completion may make when TOOLS_MAX_TURNS is not set.
+const defaultToolMaxTurns = 5
+
+// toolMaxRows caps the number of rows a single tool call returns.
+const toolMaxRows = 20
+
+// ToolSettings holds the tools a chunk's completions may call.
+type ToolSettings struct {
+	Names    []string
+	Tabs     []string
+	MaxTurns int
+}
+
+// ToolCall records a tool call made during a completion.
+type ToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// parseToolSetting applies a VARx_TOOLS, VARx_TOOLS_TABS or VARx_TOOLS_MAX_TURNS setting.
+// It returns true if the property is a tools setting, and an error if its value is invalid.
+func parseToolSetting(tools *ToolSettings, varProp string, varValue string) (bool, error) {
+	switch varProp {
+	case "TOOLS":
+		tools.Names = nil
+		for _, name := range strings.Split(varValue, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			switch name {
+			case "":
+				continue
+			case toolSearchRows, toolGetRow, toolLookupTab:
+				tools.Names = append(tools.Names, name)
+			default:
+				return true, fmt.Errorf("error: TOOLS must be a list of search_rows, get_row and lookup_tab. It has %s", name)
+			}
+		}
+	case "TOOLS_TABS":
+		tools.Tabs = nil
+		for _, tab := range strings.Split(varValue, ",") {
+			if tab = sheetTitle(strings.TrimSpace(tab)); tab != "" {
+				tools.Tabs = append(tools.Tabs, tab)
+			}
+		}
+	case "TOOLS_MAX_TURNS":
+		maxTurns, err := strconv.Atoi(strings.TrimSpace(varValue))
+		if err != nil {
+			return true, fmt.Errorf("error: TOOLS_MAX_TURNS is not an int. It is a %s", varValue)
+		}
+		tools.MaxTurns = maxTurns
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// maxTurns returns TOOLS_MAX_TURNS, or defaultToolMaxTurns if it is not set.
+func (t ToolSettings) maxTurns() int {
+	if t.MaxTurns > 0 {
+		return t.MaxTurns
+	}
+	return defaultToolMaxTurns
+}
+
+// enabled reports whether the chunk enabled a tool.
+func (t ToolSettings) enabled(name string) bool {
+	for _, enabled := range t.Names {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// functionDefinitions returns the function definitions of the enabled tools.
+func (t ToolSettings) functionDefinitions() []openai.FunctionDefinition {
+	var definitions []openai.FunctionDefinition
+	for _, name := range t.Names {
+		switch name {
+		case toolSearchRows:
+			definitions = append(definitions, openai.FunctionDefinition{
+				Name:        toolSearchRows,
+				Description: "Search the rows of the sheet for a text. Returns the matching rows with their row number.",
+				Parameters: json.RawMessage(fmt.Sprintf(`{"type":"object","properties":{`+
+					`"query":{"type":"string","description":"Text to look for, case-insensitive"},`+
+					`"column":{"type":"string","description":"Only search this column"},`+
+					`"limit":{"type":"integer","description":"Maximum number of rows, at most %d"}},"required":["query"]}`, toolMaxRows)),
+			})
+		case toolGetRow:
+			definitions = append(definitions, openai.FunctionDefinition{
+				Name:        toolGetRow,
+				Description: "Get a row of the sheet by its row number.",
+				Parameters:  json.RawMessage(`{"type":"object","properties":{"row":{"type":"integer","description":"Row number, the header is row 1"}},"required":["row"]}`),
+			})
+		case toolLookupTab:
+			tabs, _ := json.Marshal(t.Tabs)
+			definitions = append(definitions, openai.FunctionDefinition{
+				Name:        toolLookupTab,
+				Description: "Find the rows of another tab whose column equals a value, or its first rows if no column is given.",
+				Parameters: json.RawMessage(fmt.Sprintf(`{"type":"object","properties":{`+
+					`"tab":{"type":"string","enum":%s},`+
+					`"column":{"type":"string"},`+
+					`"value":{"type":"string","description":"Value the column must equal, case-insensitive"},`+
+					`"limit":{"type":"integer","description":"Maximum number of rows, at most %d"}},"required":["tab"]}`, tabs, toolMaxRows)),
+			})
+		}
+	}
+	return definitions
+}
+
+// toolRow returns a row of a table as an object of its header's column names, with its row number.
+func toolRow(header []interface{}, values []interface{}, rowNumber int) map[string]interface{} {
+	row := map[string]interface{}{"row": rowNumber}
+	for i, columnName := range header {
+		if i < len(values) {
+			row[fmt.Sprint(columnName)] = values[i]
+		} else {
+			row[fmt.Sprint(columnName)] = ""
+		}
+	}
+	return row
+}
+
+// toolLimit returns the number of rows a tool call asked for, capped at toolMaxRows.
+func toolLimit(limit int) int {
+	if limit <= 0 || limit > toolMaxRows {
+		return toolMaxRows
+	}
+	return limit
+}
+
+// searchRows returns the rows of the latest sheet snapshot in which a column, or any column, contains the query.
+func searchRows(query, columnName string, limit int) ([]map[string]interface{}, error) {
+	rows := sheetRows
+	matches := []map[string]interface{}{}
+	if len(rows) == 0 {
+		return matches, nil
+	}
+	columnIndex := -1
+	if columnName != "" {
+		index, ok := columnIndexByName[columnName]
+		if !ok {
+			return nil, fmt.Errorf("column %q does not exist", columnName)
+		}
+		columnIndex = index
+	}
+
+	query = strings.ToLower(query)
+	for i := 1; i < len(rows) && len(matches) < toolLimit(limit); i++ {
+		for j, value := range rows[i] {
+			if (columnIndex < 0 || j == columnIndex) && strings.Contains(strings.ToLower(fmt.Sprint(value)), query) {
+				matches = append(matches, toolRow(rows[0], rows[i], i+1))
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// lookupTabRows returns the rows of a cached tab whose column equals a value, or its first rows if no column is given.
+func lookupTabRows(tab, columnName, value string, limit int) ([]map[string]interface{}, error) {
+	lookupCacheMutex.RLock()
+	rows, ok := lookupCache[tab]
+	lookupCacheMutex.RUnlock()
+	if !ok || len(rows) == 0 {
+		return nil, fmt.Errorf("tab %q is not available", tab)
+	}
+	columnIndex := -1
+	if columnName != "" {
+		for i, name := range rows[0] {
+			if fmt.Sprint(name) == columnName {
+				columnIndex = i
+			}
+		}
+		if columnIndex < 0 {
+			return nil, fmt.Errorf("tab %q has no column %q", tab, columnName)
+		}
+	}
+
+	matches := []map[string]interface{}{}
+	for i := 1; i < len(rows) && len(matches) < toolLimit(limit); i++ {
+		if columnIndex >= 0 && (columnIndex >= len(rows[i]) || !strings.EqualFold(fmt.Sprint(rows[i][columnIndex]), value)) {
+			continue
+		}
+		matches = append(matches, toolRow(rows[0], rows[i], i+1))
+	}
+	return matches, nil
+}
+
+// callTool runs a tool call made by the model.
+// It returns the result to send back to the model as JSON, or an error message if the call failed,
+// so the model can correct its call.
+func (t ToolSettings) callTool(call *openai.FunctionCall) string {
+	var arguments struct {
+		Query  string `json:"query"`
+		Column string `json:"column"`
+		Row    int    `json:"row"`
+		Tab    string `json:"tab"`
+		Value  string `json:"value"`
+		Limit  int    `json:"limit"`
+	}
+	var result interface{}
+	err := json.Unmarshal([]byte(call.Arguments), &arguments)
+	if err != nil {
+		err = fmt.Errorf("arguments are not a JSON object: %v", err)
+	} else if !t.enabled(call.Name) {
+		err = fmt.Errorf("unknown function %s", call.Name)
+	} else {
+		switch call.Name {
+		case toolSearchRows:
+			result, err = searchRows(arguments.Query, arguments.Column, arguments.Limit)
+		case toolGetRow:
+			rows := sheetRows
+			if arguments.Row < 2 || arguments.Row > len(rows) {
+				err = fmt.Errorf("row %d does not exist", arguments.Row)
+			} else {
+				result = toolRow(rows[0], rows[arguments.Row-1], arguments.Row)
+			}
+		case toolLookupTab:
+			tab := sheetTitle(arguments.Tab)
+			allowed := false
+			for _, name := range t.Tabs {
+				allowed = allowed || name == tab
+			}
+			if !allowed {
+				err = fmt.Errorf("tab %q is not available", arguments.Tab)
+			} else {
+				result, err = lookupTabRows(tab, arguments.Column, arguments.Value, arguments.Limit)
+			}
+		}
+	}
+	if err != nil {
+		result = map[string]string{"error": err.Error()}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error encoding %s result: %v", call.Name, err)
+		return `{"error":"result could not be encoded"}`
+	}
+	return string(b)
+}
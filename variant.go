@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// PromptVariant is a candidate definition of a chunk run next to it on triggered rows, with its output written to a
+// shadow column for comparison. Messages and model left empty are taken from the chunk.
+type PromptVariant struct {
+	SystemMessage string
+	UserMessage   string
+	Model         string
+	Column        string
+	Sample        RowFilter
+}
+
+// enabled reports whether the variant has a shadow column and differs from the chunk in at least one setting.
+func (v PromptVariant) enabled() bool {
+	return v.Column != "" && (v.SystemMessage != "" || v.UserMessage != "" || v.Model != "")
+}
+
+// parseVariantSetting applies a VARx_VARIANT_B_* setting to a variant.
+// It returns true if the property is a variant setting, and an error if its value is invalid.
+func parseVariantSetting(variant *PromptVariant, varProp string, varValue string) (bool, error) {
+	switch varProp {
+	case "VARIANT_B_SYSTEM_MESSAGE":
+		variant.SystemMessage = varValue
+	case "VARIANT_B_USER_MESSAGE":
+		variant.UserMessage = varValue
+	case "VARIANT_B_MODEL":
+		variant.Model = strings.TrimSpace(varValue)
+	case "VARIANT_B_COL":
+		variant.Column = strings.TrimSpace(varValue)
+	case "VARIANT_B_SAMPLE_PERCENT":
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(varValue), "%"), 64)
+		if err != nil {
+			return true, fmt.Errorf("error: VARIANT_B_SAMPLE_PERCENT is not a float64. It is a %s", varValue)
+		}
+		if percent <= 0 || percent > 100 {
+			return true, fmt.Errorf("error: VARIANT_B_SAMPLE_PERCENT must be more than 0 and at most 100. It is %s", varValue)
+		}
+		variant.Sample.SamplePercent = percent
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// variantB returns the chunk's settings with the variant's messages and model, writing to the variant's column.
+// The variant answers in plain text, so only the PromptColTo value of chunks with an output schema is compared.
+func (c ChunkSettings) variantB() ChunkSettings {
+	variant := c
+	variant.Name = c.Name + "/B"
+	if c.Variant.SystemMessage != "" {
+		variant.SystemMessage = c.Variant.SystemMessage
+	}
+	if c.Variant.UserMessage != "" {
+		variant.UserMessage = c.Variant.UserMessage
+	}
+	if c.Variant.Model != "" {
+		variant.Model = c.Variant.Model
+	}
+	variant.PromptColTo = c.Variant.Column
+	variant.OutputSchema = nil
+	variant.Safety.OverflowColumns = nil
+	return variant
+}
+
+// variantStats accumulates, per chunk and variant, the runs, tokens and output length of rows both variants ran on.
+type variantStats struct {
+	Runs       int
+	Tokens     int
+	Characters int
+}
+
+var variantStatsByName = make(map[string]map[string]*variantStats)
+var variantStatsMutex = &sync.Mutex{}
+
+// recordVariantRun adds a run of variant "A" or "B" of a chunk to the "Variant A" or "Variant B" stat,
+// written as "VAR3: 12 runs, 4520 tokens (377/run), 310 chars avg" for every chunk with a variant.
+func recordVariantRun(chunkName string, variant string, result *completionResult, output interface{}) {
+	variantStatsMutex.Lock()
+	defer variantStatsMutex.Unlock()
+
+	if variantStatsByName[variant] == nil {
+		variantStatsByName[variant] = make(map[string]*variantStats)
+	}
+	stats, ok := variantStatsByName[variant][chunkName]
+	if !ok {
+		stats = &variantStats{}
+		variantStatsByName[variant][chunkName] = stats
+	}
+	stats.Runs++
+	if result != nil {
+		stats.Tokens += result.Usage.TotalTokens
+	}
+	stats.Characters += utf8.RuneCountInString(fmt.Sprint(output))
+
+	names := make([]string, 0, len(variantStatsByName[variant]))
+	for name := range variantStatsByName[variant] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		s := variantStatsByName[variant][name]
+		parts[i] = fmt.Sprintf("%s: %d runs, %d tokens (%d/run), %d chars avg", name, s.Runs, s.Tokens, s.Tokens/s.Runs, s.Characters/s.Runs)
+	}
+	recordStat("Variant "+variant, strings.Join(parts, "; "))
+}
+
+// runVariantOnRow runs variant B of a chunk on a row its production definition just ran on, if the row is sampled,
+// and writes the variant's output to its shadow column. The production output is counted as variant A
+// so both stats cover the same rows.
+func runVariantOnRow(row map[string]interface{}, rowIndex int, gptSettings ChunkSettings, result *completionResult, output interface{}) {
+	if !gptSettings.Variant.enabled() || !gptSettings.Variant.Sample.allows(gptSettings.Name+"/B", row) {
+		return
+	}
+	if _, ok := columnLetterByName[gptSettings.Variant.Column]; !ok {
+		log.Printf("Error: VARIANT_B_COL column '%s' of '%s' does not exist", gptSettings.Variant.Column, gptSettings.Name)
+		return
+	}
+	variant := gptSettings.variantB()
+
+	systemMessage := renderTemplate(variant.SystemMessage, row)
+	userMessage := renderTemplate(variant.UserMessage, row)
+	request := newChatRequest(variant, row, systemMessage, userMessage)
+
+	variantResult, err := requestCompletion(variant, request, fmt.Sprintf("Row #%d", rowIndex))
+	var value interface{}
+	if invalid, ok := err.(*validationError); ok {
+		value = errorStatusPrefix + invalid.Err.Error()
+	} else if err != nil {
+		log.Printf("Error running variant B of '%s' on row #%d: %v", gptSettings.Name, rowIndex, err)
+		return
+	} else {
+		value = variantResult.Values[variant.guardedIndex()]
+	}
+
+	data, cells, err := prepareCellWrites(variant, rowIndex, []string{variant.PromptColTo}, []interface{}{value})
+	if err != nil {
+		log.Printf("Error preparing output: %v", err)
+		return
+	}
+	if _, err := batchWriteToSheetWithRateLimit(spreadsheetID, data, variant.Safety.valueInputOption()); err != nil {
+		log.Printf("Error updating Google Sheet: %v", err)
+		return
+	}
+	recordProvenance(rowIndex, variant, request, variantResult, cells, false)
+	log.Printf("Updated row #%v (%s) with variant B value %v\n", rowIndex, variant.PromptColTo, value)
+
+	recordVariantRun(gptSettings.Name, "A", result, output)
+	recordVariantRun(gptSettings.Name, "B", variantResult, value)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// RowFilter restricts the rows a chunk runs on.
+type RowFilter struct {
+	Where         *whereExpr
+	FirstRow      int
+	LastRow       int
+	SamplePercent float64
+}
+
+// allows reports whether a row passes the chunk's WHERE expression, ROW_RANGE and SAMPLE_PERCENT.
+// Sampling hashes the chunk name and row number, so the same rows are picked on every poll.
+func (f RowFilter) allows(chunkName string, row map[string]interface{}) bool {
+	rowIndex, _ := row["RowIndex"].(int)
+	rowNumber := rowIndex + 1
+	if f.FirstRow > 0 && rowNumber < f.FirstRow {
+		return false
+	}
+	if f.LastRow > 0 && rowNumber > f.LastRow {
+		return false
+	}
+
+	if f.SamplePercent > 0 && f.SamplePercent < 100 {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s:%d", chunkName, rowNumber)
+		if float64(h.Sum32()%10000) >= f.SamplePercent*100 {
+			return false
+		}
+	}
+
+	if f.Where != nil {
+		value, err := f.Where.eval(row)
+		if err != nil {
+			log.Printf("Error evaluating WHERE of '%s' on row #%d: %v", chunkName, rowIndex, err)
+			return false
+		}
+		return truthy(value)
+	}
+	return true
+}
+
+// parseRowRange parses a ROW_RANGE value such as "2-500", "10-" or "7".
+// It returns the first and last row number, where 0 means unbounded, or an error if the value is invalid.
+func parseRowRange(value string) (int, int, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(value), "-")
+	parse := func(s string) (int, error) {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return 0, nil
+		}
+		return strconv.Atoi(s)
+	}
+	firstRow, err := parse(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error: ROW_RANGE is not a row range. It is a %s", value)
+	}
+	if !isRange {
+		return firstRow, firstRow, nil
+	}
+	lastRow, err := parse(last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error: ROW_RANGE is not a row range. It is a %s", value)
+	}
+	return firstRow, lastRow, nil
+}
+
+// whereExpr is a node of a parsed WHERE expression.
+// Leaves are column references, string and number literals; inner nodes are operators and function calls.
+type whereExpr struct {
+	op       string
+	value    interface{}
+	column   string
+	operands []*whereExpr
+}
+
+// whereFunctions lists the functions a WHERE expression may call and how many arguments they take.
+var whereFunctions = map[string]int{
+	"len":        1,
+	"lower":      1,
+	"upper":      1,
+	"trim":       1,
+	"number":     1,
+	"contains":   2,
+	"startsWith": 2,
+	"endsWith":   2,
+}
+
+// parseWhere parses a WHERE expression such as `Status != "archived" && len(Body) > 20`.
+// Columns are referenced by name, or in square brackets when the name contains spaces: [First Name].
+// It returns an error if the expression is malformed.
+func parseWhere(expression string) (*whereExpr, error) {
+	tokens, err := tokenizeWhere(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+// whereToken is a lexical token of a WHERE expression.
+type whereToken struct {
+	kind string // "ident", "string", "number" or "op"
+	text string
+}
+
+// tokenizeWhere splits a WHERE expression into tokens.
+func tokenizeWhere(expression string) ([]whereToken, error) {
+	var tokens []whereToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			j := i + 1
+			var literal strings.Builder
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				literal.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, whereToken{kind: "string", text: literal.String()})
+			i = j + 1
+		case r == '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated column name at %d", i)
+			}
+			tokens = append(tokens, whereToken{kind: "ident", text: string(runes[i+1 : j])})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, whereToken{kind: "number", text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, whereToken{kind: "ident", text: string(runes[i:j])})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "&&", "||", "==", "!=", "<=", ">=":
+				tokens = append(tokens, whereToken{kind: "op", text: two})
+				i += 2
+				continue
+			}
+			switch r {
+			case '(', ')', ',', '<', '>', '!', '=':
+				text := string(r)
+				if text == "=" {
+					text = "=="
+				}
+				tokens = append(tokens, whereToken{kind: "op", text: text})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// whereParser is a recursive descent parser over WHERE tokens.
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+}
+
+func (p *whereParser) peek() string {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *whereParser) parseOr() (*whereExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" || p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereExpr{op: "||", operands: []*whereExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *whereParser) parseAnd() (*whereExpr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" || p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &whereExpr{op: "&&", operands: []*whereExpr{left, right}}
+	}
+	return left, nil
+}
+
+func (p *whereParser) parseComparison() (*whereExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &whereExpr{op: op, operands: []*whereExpr{left, right}}, nil
+	}
+	return left, nil
+}
+
+func (p *whereParser) parseUnary() (*whereExpr, error) {
+	if p.peek() == "!" || p.peekKeyword("not") {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &whereExpr{op: "!", operands: []*whereExpr{operand}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *whereParser) parsePrimary() (*whereExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case "string":
+		return &whereExpr{op: "literal", value: token.text}, nil
+	case "number":
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.text)
+		}
+		return &whereExpr{op: "literal", value: number}, nil
+	case "ident":
+		if arity, ok := whereFunctions[token.text]; ok && p.peek() == "(" {
+			p.pos++
+			call := &whereExpr{op: "call", column: token.text}
+			for p.peek() != ")" {
+				argument, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				call.operands = append(call.operands, argument)
+				if p.peek() == "," {
+					p.pos++
+				} else if p.peek() != ")" {
+					return nil, fmt.Errorf("expected ',' or ')' in call to %s", token.text)
+				}
+			}
+			p.pos++
+			if len(call.operands) != arity {
+				return nil, fmt.Errorf("%s takes %d argument(s), got %d", token.text, arity, len(call.operands))
+			}
+			return call, nil
+		}
+		switch token.text {
+		case "true":
+			return &whereExpr{op: "literal", value: true}, nil
+		case "false":
+			return &whereExpr{op: "literal", value: false}, nil
+		}
+		return &whereExpr{op: "column", column: token.text}, nil
+	case "op":
+		if token.text == "(" {
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.peek() != ")" {
+				return nil, fmt.Errorf("expected ')'")
+			}
+			p.pos++
+			return expr, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+// peekKeyword reports whether the next token is the given word operator, such as "and".
+func (p *whereParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == "ident" && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+// eval evaluates the expression against a row. Column values are strings; comparisons are numeric
+// when both sides are numbers and case-sensitive string comparisons otherwise.
+func (e *whereExpr) eval(row map[string]interface{}) (interface{}, error) {
+	switch e.op {
+	case "literal":
+		return e.value, nil
+	case "column":
+		value, ok := row[e.column]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", e.column)
+		}
+		if value == nil {
+			return "", nil
+		}
+		return fmt.Sprint(value), nil
+	}
+
+	operands := make([]interface{}, len(e.operands))
+	for i, operand := range e.operands {
+		// Short-circuit the logical operators
+		if i == 1 && e.op == "&&" && !truthy(operands[0]) {
+			return false, nil
+		}
+		if i == 1 && e.op == "||" && truthy(operands[0]) {
+			return true, nil
+		}
+		value, err := operand.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = value
+	}
+
+	switch e.op {
+	case "!":
+		return !truthy(operands[0]), nil
+	case "&&", "||":
+		return truthy(operands[1]), nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		return compareWhereValues(e.op, operands[0], operands[1]), nil
+	case "call":
+		switch e.column {
+		case "len":
+			return float64(len([]rune(fmt.Sprint(operands[0])))), nil
+		case "lower":
+			return strings.ToLower(fmt.Sprint(operands[0])), nil
+		case "upper":
+			return strings.ToUpper(fmt.Sprint(operands[0])), nil
+		case "trim":
+			return strings.TrimSpace(fmt.Sprint(operands[0])), nil
+		case "number":
+			number, _ := toNumber(operands[0])
+			return number, nil
+		case "contains":
+			return strings.Contains(fmt.Sprint(operands[0]), fmt.Sprint(operands[1])), nil
+		case "startsWith":
+			return strings.HasPrefix(fmt.Sprint(operands[0]), fmt.Sprint(operands[1])), nil
+		case "endsWith":
+			return strings.HasSuffix(fmt.Sprint(operands[0]), fmt.Sprint(operands[1])), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operator %q", e.op)
+}
+
+// compareWhereValues compares two values with a comparison operator.
+func compareWhereValues(op string, left, right interface{}) bool {
+	leftNumber, leftIsNumber := toNumber(left)
+	rightNumber, rightIsNumber := toNumber(right)
+
+	cmp := 0
+	if leftIsNumber && rightIsNumber {
+		switch {
+		case leftNumber < rightNumber:
+			cmp = -1
+		case leftNumber > rightNumber:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(fmt.Sprint(left), fmt.Sprint(right))
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// toNumber converts a number or a numeric string to a float64. It reports whether the conversion succeeded.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+// truthy reports whether a value counts as true: true, a non-zero number or a non-empty string.
+// Strings are read like checkbox cells: "FALSE" in any case, "0" and blank strings are false.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		v = strings.TrimSpace(v)
+		if strings.EqualFold(v, "false") {
+			return false
+		}
+		if number, ok := toNumber(v); ok {
+			return number != 0
+		}
+		return v != ""
+	}
+	return false
+}